@@ -6,6 +6,7 @@ var adminTemplate = `
 <body>
     <h1>Welcome, Chirpy Admin</h1>
     <p>Chirpy has been visited %d times!</p>
+    <p>%d refresh tokens are revoked, %d expired ones purged since start.</p>
 </body>
 
 </html>
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bootdev/database"
+	"bootdev/token"
+	"bootdev/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type contextKey int
+
+const adminIdKey contextKey = iota
+
+// RequireAdmin only lets requests with an access token
+// of a user with admin rights through
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessToken, err := token.GetBearerToken(r.Header)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		t, err := token.VerifyToken(accessToken, accessIssuer)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		idStr, err := t.Claims.GetSubject()
+		if err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		id, _ := strconv.Atoi(idStr)
+
+		u, err := db.GetUser(id)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			log.Print(err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		if !u.IsAdmin {
+			utils.RespondWithError(w, http.StatusForbidden, "You are not allowed to do this")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), adminIdKey, u.Id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Backup streams a consistent snapshot of the database
+func Backup(w http.ResponseWriter, r *http.Request) {
+	filename := fmt.Sprintf("chirpy-backup-%s.json", time.Now().UTC().Format("20060102-150405"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	err := db.Backup(w)
+	if err != nil {
+		// headers are gone once the body started, this
+		// only helps when the snapshot failed up front
+		log.Print("Backup: ", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+	}
+}
+
+// Restore replaces the database with the backup in the request body
+func Restore(w http.ResponseWriter, r *http.Request) {
+	err := db.Restore(r.Body)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidBackup) {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Print("Restore: ", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	log.Printf("database restored by admin %d", r.Context().Value(adminIdKey))
+
+	utils.RespondWithJSON(w, http.StatusOK, nil)
+}
+
+// DeleteAnyUser deletes a user the way they can delete themselves
+func DeleteAnyUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	u, err := db.DeleteUser(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	log.Printf("user %d deleted by admin %d", id, r.Context().Value(adminIdKey))
+
+	utils.RespondWithJSON(w, http.StatusOK, u.Account())
+}
@@ -2,22 +2,57 @@ package api
 
 import (
 	"bootdev/database"
+	"bootdev/moderation"
 	"bootdev/token"
 	"bootdev/utils"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
-	"sort"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
-const censor = "****"
+var (
+	errChirpTooLong  = errors.New("Chirp is too long")
+	errChirpRejected = errors.New("Chirp is not allowed")
+)
+
+// moderator holds the rules chirps are checked against
+var moderator = moderation.Default()
+
+// SetModerator sets the rules new and edited chirps are checked against
+func SetModerator(m *moderation.Moderator) {
+	moderator = m
+}
+
+// editWindow is how long after posting authors can edit a chirp
+var editWindow = 15 * time.Minute
+
+// SetEditWindow sets how long authors can edit their chirps
+// for, zero turns editing off
+func SetEditWindow(d time.Duration) {
+	editWindow = d
+}
+
+// checkChirp applies the rules every chirp body follows, the
+// verdict has the body as censored and the rules that flagged it
+func checkChirp(body string) (moderation.Verdict, error) {
+	if len(body) > 140 {
+		return moderation.Verdict{}, errChirpTooLong
+	}
+
+	v := moderator.Check(body)
+	if v.RejectedBy != "" {
+		return v, errChirpRejected
+	}
 
-var bannedWords = []string{"kerfuffle", "sharbert", "fornax"}
+	return v, nil
+}
 
 func Healthz(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -60,28 +95,32 @@ func CreateChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(c.Body) > 140 {
-		utils.RespondWithError(w, http.StatusBadRequest, "Chirp is too long")
+	verdict, err := checkChirp(c.Body)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	words := strings.Split(c.Body, " ")
-	for i, w := range words {
-		for _, bw := range bannedWords {
-			if strings.EqualFold(w, bw) {
-				words[i] = censor
-			}
-		}
+	if c.InReplyTo < 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "in_reply_to is not valid id")
+		return
 	}
-	censoredText := strings.Join(words, " ")
 
-	chirp, err := db.CreateChirp(id, censoredText)
+	chirp, err := db.CreateChirp(id, verdict.Body, c.InReplyTo, verdict.Flags)
 	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			utils.RespondWithError(w, http.StatusUnauthorized, "user deleted")
+			return
+		}
+		if errors.Is(err, database.ErrInvalidReply) {
+			utils.RespondWithError(w, http.StatusBadRequest, "Chirp replied to does not exist")
+			return
+		}
 		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusCreated, chirp)
+	utils.RespondWithJSON(w, http.StatusCreated, chirp.Public())
 	return
 }
 
@@ -103,48 +142,258 @@ func GetChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, c)
+	utils.RespondWithJSON(w, http.StatusOK, c.Public())
+}
+
+// GetThread returns the thread a chirp is part of, from the chirp
+// that started it down through every reply. Deleted chirps that
+// have replies stay in as tombstones
+func GetThread(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	t, err := db.GetThread(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, t.Public())
 }
 
+// GetChrips returns a page of chirps in id or creation order, limit of
+// them or 20. X-Next-Cursor is set while there are more, pass it as
+// after to get the next page
 func GetChrips(w http.ResponseWriter, r *http.Request) {
-	chirps, err := db.GetChirps()
+	q, err := chirpQuery(r.URL.Query())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondWithChirpPage(w, q)
+}
+
+// chirpQuery reads the filters and paging parameters chirp lists share
+func chirpQuery(query url.Values) (database.ChirpQuery, error) {
+	q := database.ChirpQuery{}
+
+	var err error
+
+	q.Sort, q.Desc, err = chirpSort(query.Get("sort"))
+	if err != nil {
+		return q, err
+	}
+
+	for param, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		*t, err = timeParam(query, param)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	aIdStr := query.Get("author_id")
+	if aIdStr != "" {
+		q.AuthorId, err = strconv.Atoi(aIdStr)
+		if err != nil {
+			return q, errors.New("author_id is not valid id")
+		}
+	}
+
+	for param, cur := range map[string]*database.Cursor{"after": &q.After, "before": &q.Before} {
+		cursor := query.Get(param)
+		if cursor == "" {
+			continue
+		}
+
+		*cur, err = decodeCursor(cursor)
+		if err != nil {
+			return q, errors.New(param + " is " + err.Error())
+		}
+	}
+
+	q.Limit, err = pageLimit(query)
+
+	return q, err
+}
+
+// respondWithChirpPage writes the chirps q selects, with X-Next-Cursor
+// set while there are more
+func respondWithChirpPage(w http.ResponseWriter, q database.ChirpQuery) {
+	limit := q.Limit
+
+	// one chirp past the page tells whether there is a next one
+	q.Limit++
+
+	chirps, err := db.GetChirps(q)
 	if err != nil {
 		log.Print(err)
 		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
-	aId := -1
+	more := len(chirps) > limit
+	if q.Before.Id != 0 && q.After.Id == 0 {
+		// read back from before, the extra chirp comes first and the
+		// next page starts at before
+		if more {
+			chirps = chirps[1:]
+		}
+		more = len(chirps) > 0
+	} else if more {
+		chirps = chirps[:limit]
+	}
+
+	if more {
+		last := chirps[len(chirps)-1]
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.Id, last.CreatedAt))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, database.PublicChirps(chirps))
+}
+
+// SearchChirps returns the chirps with every word of q, best match
+// first. Words in double quotes have to appear next to each other
+func SearchChirps(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	q := database.SearchQuery{
+		Text: query.Get("q"),
+	}
 
-	aIdStr := r.URL.Query().Get("author_id")
-	sortBy := r.URL.Query().Get("sort")
+	if strings.TrimSpace(q.Text) == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "q is required")
+		return
+	}
 
+	var err error
+
+	aIdStr := query.Get("author_id")
 	if aIdStr != "" {
-		aId, err = strconv.Atoi(aIdStr)
+		q.AuthorId, err = strconv.Atoi(aIdStr)
 		if err != nil {
-			utils.RespondWithError(w, http.StatusInternalServerError, "author_id is not valid id")
+			utils.RespondWithError(w, http.StatusBadRequest, "author_id is not valid id")
 			return
 		}
 	}
 
-	if aId != -1 {
-		chirpsCopy := chirps
-		chirps = []database.Chirp{}
-		for _, c := range chirpsCopy {
-			if aId == c.AuthorId {
-				chirps = append(chirps, c)
-			}
+	q.Limit, err = pageLimit(query)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirps, err := db.SearchChirps(q)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, database.PublicChirps(chirps))
+}
+
+// EditChirp replaces the body of a chirp, only its author can and only
+// within the edit window after posting. The old body is kept as a
+// revision and the chirp is marked with when it was edited
+func EditChirp(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	uidStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	uId, _ := strconv.Atoi(uidStr)
+
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	edit := database.Chirp{}
+
+	err = json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid request")
+		return
+	}
+
+	verdict, err := checkChirp(edit.Body)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, err := db.EditChirp(id, uId, verdict.Body, verdict.Flags, editWindow)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			utils.RespondWithError(w, http.StatusUnauthorized, "user deleted")
+			return
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+			return
 		}
+		if errors.Is(err, database.ErrNotAuthor) {
+			utils.RespondWithError(w, http.StatusForbidden, "You are not allowed to do this")
+			return
+		}
+		if errors.Is(err, database.ErrEditWindowClosed) {
+			utils.RespondWithError(w, http.StatusForbidden, "Chirp can no longer be edited")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
 	}
 
-	sort.Slice(chirps, func(i, j int) bool {
-		if sortBy != "" && sortBy == "desc" {
-			return chirps[i].Id > chirps[j].Id
+	utils.RespondWithJSON(w, http.StatusOK, chirp.Public())
+}
+
+// GetRevisions returns the bodies an edited chirp had before, oldest first
+func GetRevisions(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	revisions, err := db.GetRevisions(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+			return
 		}
-		return chirps[i].Id < chirps[j].Id
-	})
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
 
-	utils.RespondWithJSON(w, http.StatusOK, chirps)
+	utils.RespondWithJSON(w, http.StatusOK, revisions)
 }
 
 func DeleteChirp(w http.ResponseWriter, r *http.Request) {
@@ -196,5 +445,5 @@ func DeleteChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, chirp)
+	utils.RespondWithJSON(w, http.StatusOK, chirp.Public())
 }
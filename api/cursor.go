@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bootdev/database"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+var errInvalidCursor = errors.New("not a valid cursor")
+
+// encodeCursor hides the position of the item a page ended on,
+// clients hand it back as is. It holds enough to continue in any order
+func encodeCursor(id int, createdAt time.Time) string {
+	raw := fmt.Sprintf("%d.%d", id, createdAt.UnixNano())
+
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (database.Cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return database.Cursor{}, errInvalidCursor
+	}
+
+	idStr, nsStr, _ := strings.Cut(string(buf), ".")
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		return database.Cursor{}, errInvalidCursor
+	}
+
+	ns, err := strconv.ParseInt(nsStr, 10, 64)
+	if err != nil {
+		return database.Cursor{}, errInvalidCursor
+	}
+
+	return database.Cursor{Id: id, CreatedAt: time.Unix(0, ns).UTC()}, nil
+}
+
+// chirpSort reads the sort parameter, asc and desc order by id
+func chirpSort(sortBy string) (database.ChirpSort, bool, error) {
+	switch sortBy {
+	case "", "asc":
+		return database.SortById, false, nil
+	case "desc":
+		return database.SortById, true, nil
+	case "created_at":
+		return database.SortByCreatedAt, false, nil
+	case "created_at_desc":
+		return database.SortByCreatedAt, true, nil
+	default:
+		return "", false, errors.New("sort must be asc, desc, created_at or created_at_desc")
+	}
+}
+
+// timeParam reads an RFC 3339 time, the zero time if it is missing
+func timeParam(query url.Values, param string) (time.Time, error) {
+	value := query.Get(param)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a time like %s", param, time.RFC3339)
+	}
+
+	return t, nil
+}
+
+// pageLimit reads the limit parameter, lists are always paged so one
+// request can't return everything
+func pageLimit(query url.Values) (int, error) {
+	limitStr := query.Get("limit")
+	if limitStr == "" {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("limit must be a positive number")
+	}
+
+	return min(limit, maxPageLimit), nil
+}
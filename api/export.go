@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bootdev/database"
+	"bootdev/token"
+	"bootdev/utils"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exportInterval is how long users wait between two exports
+var exportInterval = time.Hour
+
+// exports holds when each user last exported their data
+var exports = struct {
+	sync.Mutex
+	at map[int]time.Time
+}{at: map[int]time.Time{}}
+
+// SetExportInterval sets how long users wait between two exports,
+// it must be called before the server starts
+func SetExportInterval(d time.Duration) {
+	exportInterval = d
+}
+
+// allowExport reports whether the user may export now and otherwise how
+// long they have to wait. An allowed export takes the slot right away so
+// a second request can't slip in, releaseExport gives it back if the
+// export fails. Users whose wait is over are forgotten
+func allowExport(userId int, now time.Time) (bool, time.Duration) {
+	exports.Lock()
+	defer exports.Unlock()
+
+	if wait := exportInterval - now.Sub(exports.at[userId]); wait > 0 {
+		return false, wait
+	}
+
+	for id, at := range exports.at {
+		if now.Sub(at) >= exportInterval {
+			delete(exports.at, id)
+		}
+	}
+
+	exports.at[userId] = now
+
+	return true, 0
+}
+
+// releaseExport forgets an export allowed at that didn't go through,
+// so only exports the user got count against them
+func releaseExport(userId int, at time.Time) {
+	exports.Lock()
+	defer exports.Unlock()
+
+	if exports.at[userId].Equal(at) {
+		delete(exports.at, userId)
+	}
+}
+
+// ExportUser sends the signed in user a zip of their account, chirps
+// and login history, at most once every exportInterval
+func ExportUser(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	idStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	id, _ := strconv.Atoi(idStr)
+
+	now := time.Now()
+
+	ok, wait := allowExport(id, now)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		utils.RespondWithError(w, http.StatusTooManyRequests, "You exported your data recently, try again later")
+		return
+	}
+
+	e, err := db.ExportUser(id)
+	if err != nil {
+		releaseExport(id, now)
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	// built up front so a failure can still be answered with an error
+	buf := bytes.Buffer{}
+	err = e.WriteArchive(&buf)
+	if err != nil {
+		releaseExport(id, now)
+		log.Print("WriteArchive: ", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	filename := fmt.Sprintf("chirpy-export-%d-%s.zip", id, e.ExportedAt.Format("20060102-150405"))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bootdev/database"
+	"bootdev/token"
+	"bootdev/utils"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Follow makes the user follow another, doing it again changes nothing
+func Follow(w http.ResponseWriter, r *http.Request) {
+	followHandler(w, r, true)
+}
+
+// Unfollow stops the user following another
+func Unfollow(w http.ResponseWriter, r *http.Request) {
+	followHandler(w, r, false)
+}
+
+func followHandler(w http.ResponseWriter, r *http.Request, follow bool) {
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	uidStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	uId, _ := strconv.Atoi(uidStr)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	var f database.Follow
+	if follow {
+		f, err = db.Follow(uId, id)
+	} else {
+		err = db.Unfollow(uId, id)
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			utils.RespondWithError(w, http.StatusUnauthorized, "user deleted")
+			return
+		}
+		if errors.Is(err, database.ErrFollowSelf) {
+			utils.RespondWithError(w, http.StatusBadRequest, "You can't follow yourself")
+			return
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if !follow {
+		utils.RespondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, f)
+}
+
+// GetFollows lists the followers of a user, or the users they follow,
+// newest first. X-Next-Cursor works as for chirps
+func GetFollows(following bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+			return
+		}
+
+		query := r.URL.Query()
+
+		q := database.FollowQuery{
+			UserId:    id,
+			Following: following,
+		}
+
+		if after := query.Get("after"); after != "" {
+			q.After, err = decodeCursor(after)
+			if err != nil {
+				utils.RespondWithError(w, http.StatusBadRequest, "after is "+err.Error())
+				return
+			}
+		}
+
+		q.Limit, err = pageLimit(query)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		follows, err := db.GetFollows(q)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				utils.RespondWithError(w, http.StatusNotFound, "User does not exist")
+				return
+			}
+			log.Print(err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		if len(follows) == q.Limit {
+			last := follows[len(follows)-1]
+			otherId := last.FollowerId
+			if following {
+				otherId = last.FolloweeId
+			}
+
+			w.Header().Set("X-Next-Cursor", encodeCursor(otherId, last.CreatedAt))
+		}
+
+		utils.RespondWithJSON(w, http.StatusOK, follows)
+	}
+}
+
+// GetTimeline returns the chirps of the user and of the users they
+// follow, newest first. X-Next-Cursor works as for chirps
+func GetTimeline(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	idStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	id, _ := strconv.Atoi(idStr)
+
+	query := r.URL.Query()
+
+	q := database.TimelineQuery{UserId: id}
+
+	if after := query.Get("after"); after != "" {
+		q.After, err = decodeCursor(after)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "after is "+err.Error())
+			return
+		}
+	}
+
+	q.Limit, err = pageLimit(query)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirps, err := db.GetTimeline(q)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if len(chirps) == q.Limit {
+		last := chirps[len(chirps)-1]
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.Id, last.CreatedAt))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, database.PublicChirps(chirps))
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"bootdev/database"
+	"bootdev/token"
+	"bootdev/utils"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxReportReason = 500
+
+// ReportChirp files a report on a chirp for the admins to look at,
+// reporting a chirp again while the first report is open changes nothing
+func ReportChirp(w http.ResponseWriter, r *http.Request) {
+	type reportRequest struct {
+		Reason string `json:"reason"`
+	}
+
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	uidStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	uId, _ := strconv.Atoi(uidStr)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	req := reportRequest{}
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid request")
+		return
+	}
+
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		utils.RespondWithError(w, http.StatusBadRequest, "A reason is required")
+		return
+	}
+	if utf8.RuneCountInString(reason) > maxReportReason {
+		utils.RespondWithError(w, http.StatusBadRequest, "Reason is too long")
+		return
+	}
+
+	report, err := db.ReportChirp(id, uId, reason)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			utils.RespondWithError(w, http.StatusUnauthorized, "user deleted")
+			return
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusCreated, report)
+}
+
+// GetModerationQueue lists the reported and flagged chirps waiting for
+// an admin, oldest first, X-Next-Cursor works as for chirps
+func GetModerationQueue(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	q := database.QueueQuery{}
+
+	if after := query.Get("after"); after != "" {
+		cur, err := decodeCursor(after)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "after is "+err.Error())
+			return
+		}
+
+		q.After = cur.Id
+	}
+
+	var err error
+
+	q.Limit, err = pageLimit(query)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	queue, err := db.GetModerationQueue(q)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if len(queue) == q.Limit {
+		last := queue[len(queue)-1].Chirp
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.Id, last.CreatedAt))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, queue)
+}
+
+// Moderate hides, deletes or dismisses a chirp, closing its open
+// reports. The action is kept with the admin that took it
+func Moderate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	action := chi.URLParam(r, "action")
+	if action != database.ModerationHide && action != database.ModerationDelete && action != database.ModerationDismiss {
+		utils.RespondWithError(w, http.StatusBadRequest, "action must be hide, delete or dismiss")
+		return
+	}
+
+	adminId, _ := r.Context().Value(adminIdKey).(int)
+
+	a, err := db.Moderate(id, adminId, action)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	log.Printf("chirp %d: %s by admin %d", id, action, adminId)
+
+	utils.RespondWithJSON(w, http.StatusOK, a)
+}
+
+// GetModerationActions lists what admins did, newest first,
+// X-Next-Cursor works as for chirps
+func GetModerationActions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	q := database.ModerationActionQuery{}
+
+	if after := query.Get("after"); after != "" {
+		cur, err := decodeCursor(after)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "after is "+err.Error())
+			return
+		}
+
+		q.After = cur.Id
+	}
+
+	var err error
+
+	q.Limit, err = pageLimit(query)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	actions, err := db.GetModerationActions(q)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if len(actions) == q.Limit {
+		last := actions[len(actions)-1]
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.Id, last.CreatedAt))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, actions)
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"bootdev/database"
+	"bootdev/token"
+	"bootdev/utils"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GetUserMentions returns the chirps mentioning a user, paged like GetChrips
+func GetUserMentions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	q, err := chirpQuery(r.URL.Query())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q.Mentions = id
+
+	respondWithChirpPage(w, q)
+}
+
+// GetNotifications returns the inbox of the user, newest first. With
+// unread=true only unread notifications, X-Next-Cursor works as for chirps
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	idStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	id, _ := strconv.Atoi(idStr)
+
+	query := r.URL.Query()
+
+	q := database.NotificationQuery{
+		UserId:     id,
+		UnreadOnly: query.Get("unread") == "true",
+	}
+
+	if after := query.Get("after"); after != "" {
+		cur, err := decodeCursor(after)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "after is "+err.Error())
+			return
+		}
+
+		q.After = cur.Id
+	}
+
+	q.Limit, err = pageLimit(query)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	notifications, err := db.GetNotifications(q)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if len(notifications) == q.Limit {
+		last := notifications[len(notifications)-1]
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.Id, last.CreatedAt))
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, notifications)
+}
+
+// ReadNotifications marks the notifications with the given ids
+// as read, or all of them without a body
+func ReadNotifications(w http.ResponseWriter, r *http.Request) {
+	type readRequest struct {
+		Ids []int `json:"ids"`
+	}
+
+	type readResponse struct {
+		Read int `json:"read"`
+	}
+
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	idStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	id, _ := strconv.Atoi(idStr)
+
+	req := readRequest{}
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid request")
+		return
+	}
+
+	n, err := db.MarkNotificationsRead(id, req.Ids)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, readResponse{n})
+}
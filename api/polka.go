@@ -41,11 +41,11 @@ func UpgradeUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := db.UpdateUser(uReq.Data.UserId, "", "", true)
+	u, err := db.UpdateUser(uReq.Data.UserId, "", "", "", database.ProfileUpdate{}, true)
 	if err == database.ErrNotFound {
 		utils.RespondWithError(w, http.StatusNotFound, err.Error())
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, u)
+	utils.RespondWithJSON(w, http.StatusOK, u.Account())
 }
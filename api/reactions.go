@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bootdev/database"
+	"bootdev/token"
+	"bootdev/utils"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AddReaction likes or rechirps the chirp for the user, doing it
+// again changes nothing. It responds with the chirp and its counters
+func AddReaction(kind string) http.HandlerFunc {
+	return reactionHandler(kind, true)
+}
+
+// RemoveReaction takes back a like or rechirp of the user
+func RemoveReaction(kind string) http.HandlerFunc {
+	return reactionHandler(kind, false)
+}
+
+func reactionHandler(kind string, add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accessToken, err := token.GetBearerToken(r.Header)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		t, err := token.VerifyToken(accessToken, accessIssuer)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		uidStr, err := t.Claims.GetSubject()
+		if err != nil {
+			utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		uId, _ := strconv.Atoi(uidStr)
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+			return
+		}
+
+		react := db.RemoveReaction
+		if add {
+			react = db.AddReaction
+		}
+
+		c, err := react(kind, id, uId)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotFound) {
+				utils.RespondWithError(w, http.StatusUnauthorized, "user deleted")
+				return
+			}
+			if errors.Is(err, database.ErrNotFound) {
+				utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+				return
+			}
+			log.Print(err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		utils.RespondWithJSON(w, http.StatusOK, c.Public())
+	}
+}
+
+// GetReactions lists who liked or rechirped a chirp, newest first,
+// X-Next-Cursor works as for chirps
+func GetReactions(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+			return
+		}
+
+		query := r.URL.Query()
+
+		q := database.ReactionQuery{
+			Kind:    kind,
+			ChirpId: id,
+		}
+
+		if after := query.Get("after"); after != "" {
+			q.After, err = decodeCursor(after)
+			if err != nil {
+				utils.RespondWithError(w, http.StatusBadRequest, "after is "+err.Error())
+				return
+			}
+		}
+
+		q.Limit, err = pageLimit(query)
+		if err != nil {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		reactions, err := db.GetReactions(q)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				utils.RespondWithError(w, http.StatusNotFound, "Chirp does not exist")
+				return
+			}
+			log.Print(err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		if len(reactions) == q.Limit {
+			last := reactions[len(reactions)-1]
+			w.Header().Set("X-Next-Cursor", encodeCursor(last.UserId, last.CreatedAt))
+		}
+
+		utils.RespondWithJSON(w, http.StatusOK, reactions)
+	}
+}
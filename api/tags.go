@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bootdev/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultTrendingWindow = 24 * time.Hour
+	maxTrendingWindow     = 30 * 24 * time.Hour
+	defaultTrendingLimit  = 10
+)
+
+// GetTagChirps returns the chirps with a hashtag, paged like GetChrips
+func GetTagChirps(w http.ResponseWriter, r *http.Request) {
+	q, err := chirpQuery(r.URL.Query())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q.Tag = chi.URLParam(r, "tag")
+
+	respondWithChirpPage(w, q)
+}
+
+// TrendingTags returns the tags most used by chirps created within the
+// window before now, a duration like 1h or 90m
+func TrendingTags(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	window := defaultTrendingWindow
+	if windowStr := query.Get("window"); windowStr != "" {
+		var err error
+
+		window, err = time.ParseDuration(windowStr)
+		if err != nil || window <= 0 || window > maxTrendingWindow {
+			utils.RespondWithError(w, http.StatusBadRequest, "window must be a duration up to 720h")
+			return
+		}
+	}
+
+	limit := defaultTrendingLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			utils.RespondWithError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(limit, maxPageLimit)
+	}
+
+	tags, err := db.TrendingTags(time.Now().Add(-window), limit)
+	if err != nil {
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, tags)
+}
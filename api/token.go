@@ -1,8 +1,10 @@
 package api
 
 import (
+	"bootdev/database"
 	"bootdev/token"
 	"bootdev/utils"
+	"errors"
 	"net/http"
 	"strconv"
 )
@@ -42,6 +44,18 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id, _ := strconv.Atoi(idStr)
+
+	// ids are never reused, so this shuts out deleted users for good
+	_, err = db.GetUser(id)
+	if errors.Is(err, database.ErrNotFound) {
+		utils.RespondWithError(w, http.StatusUnauthorized, "user deleted")
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
 	t, err := token.CreateToken(accessTokenExpiry, id, accessIssuer)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong")
@@ -58,13 +72,20 @@ func RevokeToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = token.VerifyToken(refreshToken, refreshIssuer)
+	t, err := token.VerifyToken(refreshToken, refreshIssuer)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
 		return
 	}
 
-	err = db.RevokeToken(refreshToken)
+	// the revocation only has to outlive the token
+	exp, err := t.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	err = db.RevokeToken(refreshToken, exp.Time)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong")
 		return
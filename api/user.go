@@ -7,12 +7,21 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
-var db = database.GetDb()
+var db database.Store
+
+// SetStore sets the store used by all handlers,
+// it must be called before the server starts
+func SetStore(s database.Store) {
+	db = s
+}
 
 const (
 	accessIssuer       = "chirpy-access"
@@ -22,9 +31,15 @@ const (
 )
 
 func CreateUser(w http.ResponseWriter, r *http.Request) {
+	type createRequest struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Handle   string `json:"handle"`
+	}
+
 	decoder := json.NewDecoder(r.Body)
 
-	u := &database.User{}
+	u := &createRequest{}
 
 	err := decoder.Decode(&u)
 	if err != nil {
@@ -32,21 +47,40 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := db.CreateUser(u.Email, u.Password)
+	user, err := db.CreateUser(u.Email, u.Password, u.Handle)
 	if err != nil {
 		if errors.Is(err, database.ErrDuplicateEmail) {
 			utils.RespondWithError(w, http.StatusUnauthorized, "User with email already exists")
 			return
 		}
+		if errors.Is(err, database.ErrDuplicateHandle) {
+			utils.RespondWithError(w, http.StatusConflict, "Handle is taken")
+			return
+		}
+		if errors.Is(err, database.ErrInvalidHandle) {
+			utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusCreated, user)
+	utils.RespondWithJSON(w, http.StatusCreated, user.Account())
 	return
 }
 
+// UpdateUser changes the signed in user's account and profile, fields
+// left out stay as they are. Profile fields set to "" are cleared
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	type updateRequest struct {
+		Email       string  `json:"email"`
+		Password    string  `json:"password"`
+		Handle      string  `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
+	}
+
 	accessToken, err := token.GetBearerToken(r.Header)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
@@ -75,7 +109,7 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 
 	decoder := json.NewDecoder(r.Body)
 
-	u := &database.User{}
+	u := &updateRequest{}
 
 	err = decoder.Decode(&u)
 	if err != nil {
@@ -84,17 +118,94 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := db.UpdateUser(id, u.Email, u.Password, false)
+	profile := database.ProfileUpdate{
+		DisplayName: u.DisplayName,
+		Bio:         u.Bio,
+		AvatarURL:   u.AvatarURL,
+	}
+
+	res, err := db.UpdateUser(id, u.Email, u.Password, u.Handle, profile, false)
+	if errors.Is(err, database.ErrDuplicateEmail) {
+		utils.RespondWithError(w, http.StatusConflict, "User with email already exists")
+		return
+	}
+	if errors.Is(err, database.ErrDuplicateHandle) {
+		utils.RespondWithError(w, http.StatusConflict, "Handle is taken")
+		return
+	}
+	if errors.Is(err, database.ErrInvalidHandle) || errors.Is(err, database.ErrInvalidProfile) {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, res)
+	utils.RespondWithJSON(w, http.StatusOK, res.Account())
 	return
 }
 
+// DeleteUser deletes the signed in user along with their chirps,
+// reactions, follows and notifications
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := token.GetBearerToken(r.Header)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	t, err := token.VerifyToken(accessToken, accessIssuer)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	idStr, err := t.Claims.GetSubject()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	id, _ := strconv.Atoi(idStr)
+
+	u, err := db.DeleteUser(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, u.Account())
+}
+
+// GetUserProfile returns the public profile of a user
+func GetUserProfile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "Not a valid id")
+		return
+	}
+
+	p, err := db.GetProfile(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			utils.RespondWithError(w, http.StatusNotFound, "User does not exist")
+			return
+		}
+		log.Print(err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, p)
+}
+
 func Login(w http.ResponseWriter, r *http.Request) {
 	type loginRequest struct {
 		Email    string `json:"email,omitempty"`
@@ -102,7 +213,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type loginResponse struct {
-		database.User
+		database.Account
 		Token        string `json:"token,omitempty"`
 		RefreshToken string `json:"refresh_token,omitempty"`
 	}
@@ -135,8 +246,25 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res := loginResponse{user, accessToken, refreshToken}
+	// the history is for the user to look back on,
+	// failing to keep it doesn't stop them signing in
+	err = db.RecordLogin(database.Login{UserId: user.Id, IP: remoteIP(r), UserAgent: r.UserAgent()})
+	if err != nil {
+		log.Print("RecordLogin: ", err)
+	}
+
+	res := loginResponse{user.Account(), accessToken, refreshToken}
 
 	utils.RespondWithJSON(w, http.StatusOK, res)
 	return
 }
+
+// remoteIP is the address the request came from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
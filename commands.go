@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bootdev/database"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// dbFlags select the database every command works on
+type dbFlags struct {
+	driver string
+	path   string
+}
+
+func addDbFlags(fs *flag.FlagSet) *dbFlags {
+	f := &dbFlags{}
+	fs.StringVar(&f.driver, "db", database.DriverJSON, "database driver, json or sqlite")
+	fs.StringVar(&f.path, "db-path", "", "database file, defaults to db.json or chirpy.db")
+
+	return f
+}
+
+// migrate upgrades the database to the schema version of this build
+// ahead of time and keeps a copy of the old file, the server does the
+// same when it opens an older database
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	db := addDbFlags(fs)
+	fs.Parse(args)
+
+	from, to, err := database.Migrate(db.driver, db.path)
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		fmt.Printf("Database is up to date at version %d\n", to)
+		return nil
+	}
+
+	fmt.Printf("Migrated database from version %d to %d\n", from, to)
+
+	return nil
+}
+
+// backup writes a snapshot of the database to a file, or stdout.
+// Use GET /admin/backup while the server is running
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	db := addDbFlags(fs)
+	out := fs.String("o", "", "file to write the backup to, defaults to stdout")
+	fs.Parse(args)
+
+	store, err := database.Open(db.driver, db.path, database.Options{})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *out == "" {
+		return store.Backup(os.Stdout)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+
+	err = store.Backup(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// restore replaces the database with a backup file.
+// Use POST /admin/restore while the server is running
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	db := addDbFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: restore [flags] <backup file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := database.Open(db.driver, db.path, database.Options{})
+	if err != nil {
+		return err
+	}
+
+	err = store.Restore(f)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored database from %s\n", fs.Arg(0))
+
+	return nil
+}
+
+// grantAdmin gives a user access to the admin endpoints
+func grantAdmin(args []string) error {
+	fs := flag.NewFlagSet("grant-admin", flag.ExitOnError)
+	db := addDbFlags(fs)
+	revoke := fs.Bool("revoke", false, "take admin rights away instead")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: grant-admin [flags] <email>")
+	}
+
+	store, err := database.Open(db.driver, db.path, database.Options{})
+	if err != nil {
+		return err
+	}
+
+	u, err := store.SetAdmin(fs.Arg(0), !*revoke)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("User %d is admin: %t\n", u.Id, u.IsAdmin)
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"sort"
+)
+
+// DeleteUser deletes a user and everything they left behind in one update.
+// Their chirps go like deleted chirps, leaving anonymous tombstones where
+// others replied, their reactions and follows are taken back and their
+// notifications, logins and reports dropped. Moderation actions they took as an
+// admin stay for the record. Ids are never reused, so the tokens issued
+// to them stop working with the user gone
+func (db *DB) DeleteUser(id int) (User, error) {
+	var u User
+
+	err := db.Update(func(ds *DbStructure) error {
+		var ok bool
+
+		u, ok = ds.Users[id]
+		if !ok {
+			return ErrNotFound
+		}
+
+		// reactions first, they move the counters of chirps that may go below
+		for _, r := range ds.reactionsBy(id) {
+			err := ds.record(Record{Op: OpRemoveReaction, Reaction: &r})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, f := range ds.followsOf(id) {
+			err := ds.record(Record{Op: OpUnfollow, Follow: &f})
+			if err != nil {
+				return err
+			}
+		}
+
+		// newest first, so their replies to themselves go before
+		// what they reply to and don't leave tombstones behind
+		chirpIds := []int{}
+		for chirpId, c := range ds.Chirps {
+			if c.AuthorId == id && !c.Deleted {
+				chirpIds = append(chirpIds, chirpId)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(chirpIds)))
+
+		for _, chirpId := range chirpIds {
+			err := ds.deleteChirp(ds.Chirps[chirpId])
+			if err != nil {
+				return err
+			}
+		}
+
+		return ds.record(Record{Op: OpDeleteUser, Id: id})
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return u.withoutPassword(), nil
+}
+
+// reactionsBy returns the reactions of a user to any chirp
+func (ds *DbStructure) reactionsBy(userId int) []Reaction {
+	reactions := []Reaction{}
+
+	for _, kind := range []string{ReactionLike, ReactionRechirp} {
+		for chirpId, users := range ds.reactions(kind) {
+			if at, ok := users[userId]; ok {
+				reactions = append(reactions, Reaction{Kind: kind, ChirpId: chirpId, UserId: userId, CreatedAt: at})
+			}
+		}
+	}
+
+	sort.Slice(reactions, func(i, j int) bool {
+		if reactions[i].Kind != reactions[j].Kind {
+			return reactions[i].Kind < reactions[j].Kind
+		}
+		return reactions[i].ChirpId < reactions[j].ChirpId
+	})
+
+	return reactions
+}
+
+// followsOf returns the follows of a user either way round
+func (ds *DbStructure) followsOf(userId int) []Follow {
+	follows := []Follow{}
+
+	for followeeId, at := range ds.Follows[userId] {
+		follows = append(follows, Follow{FollowerId: userId, FolloweeId: followeeId, CreatedAt: at})
+	}
+
+	for followerId, at := range ds.followers[userId] {
+		follows = append(follows, Follow{FollowerId: followerId, FolloweeId: userId, CreatedAt: at})
+	}
+
+	sort.Slice(follows, func(i, j int) bool {
+		if follows[i].FollowerId != follows[j].FollowerId {
+			return follows[i].FollowerId < follows[j].FollowerId
+		}
+		return follows[i].FolloweeId < follows[j].FolloweeId
+	})
+
+	return follows
+}
+
+// checkActor makes sure the user acting exists, the access token
+// of a user who deleted their account stays valid until it expires
+func (ds *DbStructure) checkActor(id int) error {
+	if _, ok := ds.Users[id]; !ok {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// dropUser removes a user with their notifications, logins and the
+// reports they filed, the records before it took care of the rest
+func (ds *DbStructure) dropUser(id int) {
+	for _, notificationId := range ds.inbox[id] {
+		delete(ds.Notifications, notificationId)
+	}
+	delete(ds.inbox, id)
+	delete(ds.Logins, id)
+
+	for reportId, r := range ds.Reports {
+		if r.ReporterId != id {
+			continue
+		}
+
+		delete(ds.Reports, reportId)
+
+		open := ds.openReports[r.ChirpId][:0]
+		for _, openId := range ds.openReports[r.ChirpId] {
+			if openId != reportId {
+				open = append(open, openId)
+			}
+		}
+
+		if len(open) == 0 {
+			delete(ds.openReports, r.ChirpId)
+		} else {
+			ds.openReports[r.ChirpId] = open
+		}
+	}
+
+	u := ds.Users[id]
+	if userId, ok := ds.emails[normalizeEmail(u.Email)]; ok && userId == id {
+		delete(ds.emails, normalizeEmail(u.Email))
+	}
+	if userId, ok := ds.handles[u.Handle]; ok && userId == id {
+		delete(ds.handles, u.Handle)
+	}
+
+	delete(ds.Users, id)
+}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Backup writes a point in time copy of the database to w, marshalled
+// under the read lock so no update lands halfway through and written
+// after it, so a slow client doesn't hold up writers
+func (db *DB) Backup(w io.Writer) error {
+	var buf []byte
+
+	err := db.View(func(ds *DbStructure) error {
+		var err error
+		buf, err = json.MarshalIndent(ds, "", " ")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+
+	return err
+}
+
+// Restore replaces the whole database with a backup from r,
+// the backup is validated before anything is swapped in
+func (db *DB) Restore(r io.Reader) error {
+	ds, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+
+	// an interval flush must not land an older state on top
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	current, err := db.state()
+	if err != nil {
+		return err
+	}
+
+	// ids handed out after the backup was taken stay used
+	ds.keepSequences(current.Sequences)
+
+	if db.log != nil {
+		// the records in the log are older than the backup,
+		// compaction archives them behind the new snapshot
+		ds.LogSeq = db.logSeq
+		// in place, Flush reads the pointer without the lock
+		*db.cache = ds
+		db.logCount++
+
+		return db.compact()
+	}
+
+	err = db.writeDB(ds)
+	if err != nil {
+		return err
+	}
+
+	if db.cache != nil {
+		*db.cache = ds
+		db.dirty = 0
+	}
+
+	return nil
+}
+
+// readBackup decodes a backup, upgrading it if it was taken
+// at an older schema version, and validates it
+func readBackup(r io.Reader) (DbStructure, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return DbStructure{}, err
+	}
+
+	doc := document{}
+	err = json.Unmarshal(buf, &doc)
+	if err != nil {
+		return DbStructure{}, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+
+	version := 0
+	err = doc.get("version", &version)
+	if err != nil {
+		return DbStructure{}, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+
+	if version > SchemaVersion() {
+		return DbStructure{}, fmt.Errorf("%w: schema version %d is newer than this build", ErrInvalidBackup, version)
+	}
+
+	err = upgrade(doc, version)
+	if err != nil {
+		return DbStructure{}, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+
+	buf, err = json.Marshal(doc)
+	if err != nil {
+		return DbStructure{}, err
+	}
+
+	ds := DbStructure{}
+	err = json.Unmarshal(buf, &ds)
+	if err != nil {
+		return DbStructure{}, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+
+	ds.ensureMaps()
+	ds.buildIndexes()
+	ds.LogSeq = 0
+
+	err = ds.validate()
+	if err != nil {
+		return DbStructure{}, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+
+	return ds, nil
+}
+
+// keepSequences moves the sequences forward to seq where it is ahead
+func (ds *DbStructure) keepSequences(seq *Sequences) {
+	if seq == nil {
+		return
+	}
+
+	ds.Sequences.Chirps = max(ds.Sequences.Chirps, seq.Chirps)
+	ds.Sequences.Users = max(ds.Sequences.Users, seq.Users)
+	ds.Sequences.Notifications = max(ds.Sequences.Notifications, seq.Notifications)
+	ds.Sequences.Reports = max(ds.Sequences.Reports, seq.Reports)
+	ds.Sequences.ModerationActions = max(ds.Sequences.ModerationActions, seq.ModerationActions)
+}
+
+// validate checks the invariants the rest of the package relies on
+func (ds *DbStructure) validate() error {
+	if ds.Sequences == nil {
+		return errors.New("missing sequences")
+	}
+
+	for key, c := range ds.Chirps {
+		if c.Id != key {
+			return fmt.Errorf("chirp stored under id %d claims id %d", key, c.Id)
+		}
+
+		if c.Id > ds.Sequences.Chirps {
+			return fmt.Errorf("chirp %d is past the chirp sequence %d", c.Id, ds.Sequences.Chirps)
+		}
+
+		// replies come after what they reply to, so threads can't loop
+		if _, ok := ds.Chirps[c.InReplyTo]; c.InReplyTo != 0 && (!ok || c.InReplyTo >= c.Id) {
+			return fmt.Errorf("chirp %d replies to the missing chirp %d", c.Id, c.InReplyTo)
+		}
+	}
+
+	emails := map[string]int{}
+	handles := map[string]int{}
+
+	for key, u := range ds.Users {
+		if u.Id != key {
+			return fmt.Errorf("user stored under id %d claims id %d", key, u.Id)
+		}
+
+		if u.Id > ds.Sequences.Users {
+			return fmt.Errorf("user %d is past the user sequence %d", u.Id, ds.Sequences.Users)
+		}
+
+		if u.Email == "" || len(u.PasswordHash) == 0 {
+			return fmt.Errorf("user %d has no email or password", u.Id)
+		}
+
+		key := normalizeEmail(u.Email)
+		if other, ok := emails[key]; ok {
+			return fmt.Errorf("users %d and %d share an email", other, u.Id)
+		}
+		emails[key] = u.Id
+
+		if u.Handle == "" {
+			continue
+		}
+
+		if normalizeHandle(u.Handle) != u.Handle {
+			return fmt.Errorf("user %d has the invalid handle %q", u.Id, u.Handle)
+		}
+
+		if other, ok := handles[u.Handle]; ok {
+			return fmt.Errorf("users %d and %d share a handle", other, u.Id)
+		}
+		handles[u.Handle] = u.Id
+	}
+
+	err := ds.validateReactions()
+	if err == nil {
+		err = ds.validateRevisions()
+	}
+	if err == nil {
+		err = ds.validateModeration()
+	}
+	if err == nil {
+		err = ds.validateFollows()
+	}
+	if err == nil {
+		err = ds.validateLogins()
+	}
+	if err != nil {
+		return err
+	}
+
+	for key, n := range ds.Notifications {
+		if n.Id != key {
+			return fmt.Errorf("notification stored under id %d claims id %d", key, n.Id)
+		}
+
+		if n.Id > ds.Sequences.Notifications {
+			return fmt.Errorf("notification %d is past the notification sequence %d", n.Id, ds.Sequences.Notifications)
+		}
+
+		if _, ok := ds.Chirps[n.ChirpId]; n.ChirpId != 0 && !ok {
+			return fmt.Errorf("notification %d is about the missing chirp %d", n.Id, n.ChirpId)
+		}
+	}
+
+	return nil
+}
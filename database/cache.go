@@ -0,0 +1,134 @@
+package database
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Options configure the json database
+type Options struct {
+	// Cache loads the database once and serves reads from memory,
+	// without it every call reads the file from disk
+	Cache bool
+	// FlushInterval writes pending changes to disk every interval
+	FlushInterval time.Duration
+	// FlushBatch writes pending changes to disk once this many pile up
+	FlushBatch int
+	// WAL appends every change to a log next to the database file and
+	// only rewrites the file on compaction, it implies Cache and makes
+	// the flush options unnecessary since the log is always synced
+	WAL bool
+	// CompactEvery is the number of log records between compactions
+	CompactEvery int
+	// KeepSegments is how many of the log segments archived by
+	// compaction are kept, oldest removed first. 0 keeps them all
+	// as an audit trail of every change
+	KeepSegments int
+}
+
+// synchronous reports whether every update is written before it returns,
+// which is the case unless an interval or batch size is set
+func (o Options) synchronous() bool {
+	return o.FlushInterval == 0 && o.FlushBatch == 0
+}
+
+// startCache loads the database into memory
+// and starts the interval flusher if there is one
+func (db *DB) startCache() error {
+	ds, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	db.cache = &ds
+
+	if db.opts.FlushInterval > 0 {
+		db.done = make(chan struct{})
+		db.flushed = make(chan struct{})
+		go db.flushLoop()
+	}
+
+	return nil
+}
+
+func (db *DB) flushLoop() {
+	defer close(db.flushed)
+
+	ticker := time.NewTicker(db.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+			err := db.Flush()
+			if err != nil {
+				log.Print("flush: ", err)
+			}
+		}
+	}
+}
+
+// Flush writes the pending changes of a cached database to disk,
+// it is a no-op when the cache is off
+func (db *DB) Flush() error {
+	if db.cache == nil {
+		return nil
+	}
+
+	// keeps concurrent flushes from landing on disk out of order
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.Lock()
+	if db.dirty == 0 {
+		db.mux.Unlock()
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(db.cache, "", " ")
+	dirty := db.dirty
+	db.dirty = 0
+	db.mux.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(db.path, db.backupPath(), buf)
+	}
+
+	if err != nil {
+		// try again on the next flush
+		db.mux.Lock()
+		db.dirty += dirty
+		db.mux.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// Close stops the interval flusher and writes
+// any pending changes to disk
+func (db *DB) Close() error {
+	if db.log != nil {
+		db.mux.Lock()
+		defer db.mux.Unlock()
+
+		err := db.compact()
+		if err != nil {
+			return err
+		}
+
+		return db.log.Close()
+	}
+
+	if db.done != nil {
+		close(db.done)
+		<-db.flushed
+		db.done = nil
+	}
+
+	return db.Flush()
+}
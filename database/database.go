@@ -3,6 +3,8 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"os"
 	"sync"
 	"time"
@@ -13,74 +15,383 @@ import (
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+
+	opts Options
+	// cache holds the whole database when opts.Cache is set,
+	// dirty counts the updates it has that aren't on disk yet
+	cache    *DbStructure
+	dirty    int
+	flushMux sync.Mutex
+	done     chan struct{}
+	flushed  chan struct{}
+
+	// write-ahead log, logCount is the number of
+	// records appended since the last compaction
+	log      *os.File
+	logSeq   uint64
+	logCount int
+
+	// loaded is the state last read from the file without the cache,
+	// reused while loadedInfo says the file is unchanged
+	loaded     *DbStructure
+	loadedInfo os.FileInfo
+	loadedMux  sync.Mutex
 }
 
 type Chirp struct {
-	Id       int    `json:"id,omitempty"`
-	AuthorId int    `json:"author_id,omitempty"`
-	Body     string `json:"body,omitempty"`
+	Id       int      `json:"id,omitempty"`
+	AuthorId int      `json:"author_id,omitempty"`
+	Body     string   `json:"body,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Mentions are the ids of the users @mentioned in the body
+	Mentions []int `json:"mentions,omitempty"`
+	// InReplyTo is the id of the chirp this one replies to
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// Deleted marks a tombstone, see tombstone
+	Deleted      bool      `json:"deleted,omitempty"`
+	LikeCount    int       `json:"like_count"`
+	RechirpCount int       `json:"rechirp_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// EditedAt is when the body was last edited, nil if it never was
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Flags name the moderation rules that want the chirp reviewed
+	Flags []string `json:"flags,omitempty"`
+	// Hidden marks a chirp an admin took down, it is kept for the record
+	Hidden bool `json:"hidden,omitempty"`
 }
 
+// User is the stored record of a user. It holds the password hash,
+// so it is never sent to clients as is, see Account and UserProfile
 type User struct {
-	Id           int    `json:"id,omitempty"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
-	Email        string `json:"email,omitempty"`
-	Password     string `json:"password,omitempty"`
-	PasswordHash []byte `json:"password_hash,omitempty"`
+	Id          int    `json:"id,omitempty"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	IsAdmin     bool   `json:"is_admin,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Handle      string `json:"handle,omitempty"`
+	Profile
+	PasswordHash []byte    `json:"password_hash,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Account is what users see of their own record
+type Account struct {
+	Id          int    `json:"id"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	IsAdmin     bool   `json:"is_admin,omitempty"`
+	Email       string `json:"email"`
+	Handle      string `json:"handle,omitempty"`
+	Profile
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Sequences hold the last id handed out per entity,
+// ids are never reused even after a delete
+type Sequences struct {
+	Chirps            int `json:"chirps"`
+	Users             int `json:"users"`
+	Notifications     int `json:"notifications"`
+	Reports           int `json:"reports"`
+	ModerationActions int `json:"moderation_actions"`
+}
+
+// RevokedToken is a revoked refresh token, kept until it expires
+type RevokedToken struct {
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 type DbStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps,omitempty"`
-	Users         map[int]User         `json:"users,omitempty"`
-	RevokedTokens map[string]time.Time `json:"revoked_tokens,omitempty"`
+	// Version is the schema version, see migrations
+	Version int `json:"version"`
+	// LogSeq is the last write-ahead log record in the snapshot
+	LogSeq        uint64                  `json:"log_seq,omitempty"`
+	Sequences     *Sequences              `json:"sequences,omitempty"`
+	Chirps        map[int]Chirp           `json:"chirps,omitempty"`
+	Users         map[int]User            `json:"users,omitempty"`
+	RevokedTokens map[string]RevokedToken `json:"revoked_tokens,omitempty"`
+	Notifications map[int]Notification    `json:"notifications,omitempty"`
+	// Likes and Rechirps hold when users reacted, see reactions
+	Likes    map[int]map[int]time.Time `json:"likes,omitempty"`
+	Rechirps map[int]map[int]time.Time `json:"rechirps,omitempty"`
+	// Revisions are the earlier bodies of edited chirps, oldest first
+	Revisions map[int][]Revision `json:"revisions,omitempty"`
+	// Reports and ModerationActions make up the moderation queue, see moderate
+	Reports           map[int]Report           `json:"reports,omitempty"`
+	ModerationActions map[int]ModerationAction `json:"moderation_actions,omitempty"`
+	// Follows hold since when users follow others, by follower id then followee id
+	Follows map[int]map[int]time.Time `json:"follows,omitempty"`
+	// Logins are the latest logins of each user, oldest first
+	Logins map[int][]Login `json:"logins,omitempty"`
+
+	// records made by the running Update
+	pending []Record
+
+	// indexes, rebuilt on load and kept up to date by apply
+	emails   map[string]int
+	handles  map[string]int
+	chirps   sortedChirps
+	tags     map[string]*sortedChirps
+	mentions map[int]*sortedChirps
+	authored map[int]*sortedChirps
+	terms    map[string]postings
+	// replies holds the ids of the replies to each chirp, in order
+	replies map[int][]int
+	// inbox holds the notification ids of each user, in order
+	inbox map[int][]int
+	// openReports holds the ids of the open reports on each chirp, in order
+	openReports map[int][]int
+	// followers is Follows the other way around, by followee id then follower id
+	followers map[int]map[int]time.Time
 }
 
 var (
-	ErrNotFound       = errors.New("not found")
-	ErrDuplicateEmail = errors.New("email exists")
-	ErrUnAuthorized   = errors.New("unauthorized")
-	dbInstance        = &DB{
-		"db.json",
-		&sync.RWMutex{},
-	}
+	ErrNotFound        = errors.New("not found")
+	ErrUserNotFound    = errors.New("user does not exist")
+	ErrDuplicateEmail  = errors.New("email exists")
+	ErrDuplicateHandle = errors.New("handle exists")
+	ErrInvalidHandle   = errors.New("handles are 3 to 20 letters, digits or underscores")
+	ErrInvalidReply    = errors.New("chirp replied to does not exist")
+	ErrInvalidProfile  = errors.New("invalid profile")
+	ErrFollowSelf      = errors.New("users can't follow themselves")
+	ErrUnAuthorized    = errors.New("unauthorized")
+	ErrCorruptDB       = errors.New("database file is corrupt")
 )
 
-// NewDb creates a new database connection
+// NewDb creates a new json database backed by the file at path
 // and creates the database file if it doesn't exist
-func NewDb() error {
-	err := dbInstance.ensureDB()
+func NewDb(path string, opts Options) (*DB, error) {
+	db := &DB{
+		path: path,
+		mux:  &sync.RWMutex{},
+		opts: opts,
+	}
+
+	err := db.ensureDB()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case opts.WAL:
+		err = db.startLog()
+	case opts.Cache:
+		err = db.foldLog()
+		if err == nil {
+			err = db.startCache()
+		}
+	default:
+		err = db.foldLog()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// View runs fn against the current state of the database,
+// holding the read lock for the whole call. fn must not
+// keep or modify ds, it may be the shared cache
+func (db *DB) View(fn func(*DbStructure) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	ds, err := db.state()
+	if err != nil {
+		return err
+	}
+
+	return fn(ds)
+}
+
+// Update runs fn against the current state of the database and
+// saves the result, holding the write lock across the whole
+// read-modify-write. Nothing is saved if fn returns an error,
+// so fn must return any error before it modifies ds. An error
+// means the change is not saved, with write-behind caching the
+// change is saved once a later flush gets it to disk
+func (db *DB) Update(fn func(*DbStructure) error) error {
+	db.mux.Lock()
+
+	ds, err := db.state()
+	if err == nil {
+		err = fn(ds)
+	}
+
 	if err != nil {
+		if ds != nil {
+			ds.pending = nil
+		}
+		// fn may have changed the loaded state before it failed
+		if db.cache == nil {
+			db.keepLoaded(ds, err)
+		}
+		db.mux.Unlock()
 		return err
 	}
 
+	records := ds.pending
+	ds.pending = nil
+
+	if db.cache == nil {
+		err = db.writeDB(*ds)
+		db.keepLoaded(ds, err)
+		db.mux.Unlock()
+		return err
+	}
+
+	if db.log != nil {
+		defer db.mux.Unlock()
+		return db.commitLog(records)
+	}
+
+	if db.opts.synchronous() {
+		defer db.mux.Unlock()
+		return db.writeCache()
+	}
+
+	db.dirty++
+	flush := db.opts.FlushBatch > 0 && db.dirty >= db.opts.FlushBatch
+	db.mux.Unlock()
+
+	// the change is in the cache and a failed flush is tried again
+	// later, like the interval flusher, log it rather than fail a
+	// write that will still land
+	if flush {
+		err = db.Flush()
+		if err != nil {
+			log.Print("flush: ", err)
+		}
+	}
+
 	return nil
 }
 
-func GetDb() *DB {
-	return dbInstance
+// writeCache writes the cache of a synchronous database, if that fails
+// the cache goes back to what is on disk, so an update that returned an
+// error isn't written by a later one. callers must hold db.mux
+func (db *DB) writeCache() error {
+	err := db.writeDB(*db.cache)
+	if err == nil {
+		return nil
+	}
+
+	ds, loadErr := db.loadDB()
+	if loadErr != nil {
+		return fmt.Errorf("%w, and the cache can't be reloaded: %s", err, loadErr)
+	}
+
+	// in place, Flush reads the pointer without the lock
+	*db.cache = ds
+
+	return err
+}
+
+// state returns the cached database or reads it from disk,
+// callers must hold db.mux
+func (db *DB) state() (*DbStructure, error) {
+	if db.cache != nil {
+		return db.cache, nil
+	}
+
+	return db.loadedState()
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(authorId int, body string) (Chirp, error) {
-	dbStruct, err := db.loadDB()
+// loadedState reads the database file unless it is unchanged since
+// the last read, so queries without the cache don't decode and index
+// the whole database every time. callers must hold db.mux
+func (db *DB) loadedState() (*DbStructure, error) {
+	info, err := os.Stat(db.path)
 	if err != nil {
-		return Chirp{}, err
+		return nil, err
+	}
+
+	// readers share db.mux, this keeps them from loading at once
+	db.loadedMux.Lock()
+	defer db.loadedMux.Unlock()
+
+	if db.loaded != nil && sameFile(db.loadedInfo, info) {
+		return db.loaded, nil
 	}
 
-	id := len(dbStruct.Chirps) + 1
-	// nil map
-	if id-1 == 0 {
-		dbStruct.Chirps = map[int]Chirp{}
+	ds, err := db.loadDB()
+	if err != nil {
+		return nil, err
 	}
 
+	db.loaded = &ds
+	db.loadedInfo = info
+
+	return db.loaded, nil
+}
+
+// keepLoaded remembers ds as what the file holds once Update wrote it,
+// or forgets it if the write failed and ds is ahead of the file.
+// callers must hold db.mux for writing
+func (db *DB) keepLoaded(ds *DbStructure, writeErr error) {
+	db.loadedMux.Lock()
+	defer db.loadedMux.Unlock()
+
+	info, err := os.Stat(db.path)
+	if writeErr != nil || err != nil {
+		db.loaded = nil
+		return
+	}
+
+	db.loaded = ds
+	db.loadedInfo = info
+}
+
+// sameFile reports whether a and b describe the same unchanged file,
+// writes replace the file so they get a new one
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// CreateChirp creates a new chirp and saves it to disk
+func (db *DB) CreateChirp(authorId int, body string, inReplyTo int, flags []string) (Chirp, error) {
 	chirp := Chirp{
-		Id:       id,
-		AuthorId: authorId,
-		Body:     body,
+		AuthorId:  authorId,
+		Body:      body,
+		Tags:      extractTags(body),
+		InReplyTo: inReplyTo,
+		Flags:     flags,
 	}
-	dbStruct.Chirps[id] = chirp
 
-	err = db.writeDB(dbStruct)
+	err := db.Update(func(ds *DbStructure) error {
+		err := ds.checkActor(authorId)
+		if err != nil {
+			return err
+		}
+
+		if parent, ok := ds.Chirps[inReplyTo]; inReplyTo != 0 && (!ok || !parent.visible()) {
+			return ErrInvalidReply
+		}
+
+		chirp.Id = ds.nextChirpId()
+		chirp.CreatedAt = timestamp()
+		chirp.UpdatedAt = chirp.CreatedAt
+		chirp.Mentions = ds.resolveHandles(extractMentions(body))
+
+		err = ds.record(Record{Op: OpCreateChirp, Chirp: &chirp})
+		if err != nil {
+			return err
+		}
+
+		for _, n := range mentionNotifications(chirp, nil) {
+			n.Id = ds.nextNotificationId()
+
+			err = ds.record(Record{Op: OpCreateNotification, Notification: &n})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -88,49 +399,56 @@ func (db *DB) CreateChirp(authorId int, body string) (Chirp, error) {
 	return chirp, nil
 }
 
-// GetChirps returns all chirps in the database
-func (db *DB) GetChirps() ([]Chirp, error) {
-	ds, err := db.loadDB()
+// GetChirps returns a page of chirps in the order of q.Sort
+func (db *DB) GetChirps(q ChirpQuery) ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(ds *DbStructure) error {
+		chirps = ds.chirpPage(q)
+
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	chirps := make([]Chirp, 0, len(ds.Chirps))
-	for _, v := range ds.Chirps {
-		chirps = append(chirps, v)
-	}
-
 	return chirps, nil
 }
 
 func (db *DB) GetChirp(id int) (Chirp, error) {
-	ds, err := db.loadDB()
+	var c Chirp
+
+	err := db.View(func(ds *DbStructure) error {
+		var ok bool
+
+		c, ok = ds.Chirps[id]
+		if !ok || !c.visible() {
+			return ErrNotFound
+		}
+
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	c, ok := ds.Chirps[id]
-	if !ok {
-		return Chirp{}, ErrNotFound
-	}
-
 	return c, nil
 }
 
+// DeleteChirp deletes a chirp, one that has replies is left as a tombstone
 func (db *DB) DeleteChirp(id int) (Chirp, error) {
-	ds, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+	var c Chirp
 
-	c, ok := ds.Chirps[id]
-	if !ok {
-		return Chirp{}, ErrNotFound
-	}
+	err := db.Update(func(ds *DbStructure) error {
+		var ok bool
 
-	delete(ds.Chirps, id)
+		c, ok = ds.Chirps[id]
+		if !ok || !c.visible() {
+			return ErrNotFound
+		}
 
-	err = db.writeDB(ds)
+		return ds.deleteChirp(c)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -138,144 +456,354 @@ func (db *DB) DeleteChirp(id int) (Chirp, error) {
 	return c, nil
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbStruct, err := db.loadDB()
+// deleteChirp records the deletion of c, leaving a tombstone if it has
+// replies. Tombstones left without replies go too
+func (ds *DbStructure) deleteChirp(c Chirp) error {
+	if len(ds.replies[c.Id]) > 0 {
+		return ds.record(Record{Op: OpTombstoneChirp, Time: timestamp(), Id: c.Id})
+	}
+
+	err := ds.record(Record{Op: OpDeleteChirp, Id: c.Id})
 	if err != nil {
-		return User{}, err
+		return err
 	}
 
-	_, ok := db.search(email)
-	if ok {
-		return User{}, ErrDuplicateEmail
+	for parent := ds.Chirps[c.InReplyTo]; parent.Deleted && len(ds.replies[parent.Id]) == 0; parent = ds.Chirps[parent.InReplyTo] {
+		err = ds.record(Record{Op: OpDeleteChirp, Id: parent.Id})
+		if err != nil {
+			return err
+		}
 	}
 
-	id := len(dbStruct.Users) + 1
-	// nil map
-	if id-1 == 0 {
-		dbStruct.Users = map[int]User{}
+	return nil
+}
+
+// visible reports whether users get to see the chirp,
+// tombstones and hidden chirps are gone as far as they know
+func (c Chirp) visible() bool {
+	return !c.Deleted && !c.Hidden
+}
+
+func (db *DB) CreateUser(email string, password string, handle string) (User, error) {
+	handle, err := checkHandle(handle)
+	if err != nil {
+		return User{}, err
 	}
 
+	// hash outside of the lock, bcrypt is slow on purpose
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return User{}, err
 	}
 
 	u := User{
-		Id:           id,
 		Email:        email,
+		Handle:       handle,
 		PasswordHash: hash,
 		IsChirpyRed:  false,
 	}
-	dbStruct.Users[id] = u
 
-	err = db.writeDB(dbStruct)
+	err = db.Update(func(ds *DbStructure) error {
+		_, ok := ds.userByEmail(email)
+		if ok {
+			return ErrDuplicateEmail
+		}
+
+		if _, ok := ds.handles[handle]; ok && handle != "" {
+			return ErrDuplicateHandle
+		}
+
+		u.Id = ds.nextUserId()
+		u.CreatedAt = timestamp()
+		u.UpdatedAt = u.CreatedAt
+
+		return ds.record(Record{Op: OpCreateUser, User: &u})
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	return User{Id: u.Id, Email: u.Email, IsChirpyRed: u.IsChirpyRed}, nil
+	return u.withoutPassword(), nil
 }
 
-func (db *DB) UpdateUser(id int, email string, password string, isChirpyRed bool) (User, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) UpdateUser(id int, email string, password string, handle string, profile ProfileUpdate, isChirpyRed bool) (User, error) {
+	handle, err := checkHandle(handle)
 	if err != nil {
 		return User{}, err
 	}
 
-	u, ok := dbStruct.Users[id]
-	if !ok {
-		return User{}, ErrNotFound
-	}
-
+	var hash []byte
 	if password != "" {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
 			return User{}, err
 		}
-
-		u.PasswordHash = hash
 	}
 
-	if email != "" {
-		u.Email = email
-	}
+	var u User
 
-	if isChirpyRed {
-		u.IsChirpyRed = true
-	}
+	err = db.Update(func(ds *DbStructure) error {
+		var ok bool
+
+		u, ok = ds.Users[id]
+		if !ok {
+			return ErrNotFound
+		}
 
-	dbStruct.Users[id] = u
+		if hash != nil {
+			u.PasswordHash = hash
+		}
 
-	err = db.writeDB(dbStruct)
+		if email != "" {
+			other, ok := ds.userByEmail(email)
+			if ok && other.Id != id {
+				return ErrDuplicateEmail
+			}
+
+			u.Email = email
+		}
+
+		if handle != "" {
+			other, ok := ds.handles[handle]
+			if ok && other != id {
+				return ErrDuplicateHandle
+			}
+
+			u.Handle = handle
+		}
+
+		u.Profile = profile.apply(u.Profile)
+
+		err := u.Profile.check()
+		if err != nil {
+			return err
+		}
+
+		if isChirpyRed {
+			u.IsChirpyRed = true
+		}
+
+		u.UpdatedAt = timestamp()
+
+		return ds.record(Record{Op: OpUpdateUser, User: &u})
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	return User{Id: u.Id, Email: u.Email, IsChirpyRed: u.IsChirpyRed}, nil
+	return u.withoutPassword(), nil
 }
 
 func (db *DB) Login(email string, password string) (User, error) {
-	u, ok := db.search(email)
-	if !ok {
-		return User{}, ErrNotFound
+	var u User
+
+	err := db.View(func(ds *DbStructure) error {
+		var ok bool
+
+		u, ok = ds.userByEmail(email)
+		if !ok {
+			return ErrNotFound
+		}
+
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password))
+	err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password))
 	if err != nil {
 		return User{}, ErrUnAuthorized
 	}
 
-	return User{Id: u.Id, Email: u.Email, IsChirpyRed: u.IsChirpyRed}, nil
+	return u.withoutPassword(), nil
 }
 
-func (db *DB) RevokeToken(token string) error {
-	dbStruct, err := db.loadDB()
+func (db *DB) GetUser(id int) (User, error) {
+	var u User
+
+	err := db.View(func(ds *DbStructure) error {
+		var ok bool
+
+		u, ok = ds.Users[id]
+		if !ok {
+			return ErrNotFound
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
-	size := len(dbStruct.RevokedTokens)
-	// nil map
-	if size == 0 {
-		dbStruct.RevokedTokens = map[string]time.Time{}
+	return u.withoutPassword(), nil
+}
+
+// SetAdmin grants or takes away access to the admin endpoints
+func (db *DB) SetAdmin(email string, isAdmin bool) (User, error) {
+	var u User
+
+	err := db.Update(func(ds *DbStructure) error {
+		var ok bool
+
+		u, ok = ds.userByEmail(email)
+		if !ok {
+			return ErrNotFound
+		}
+
+		u.IsAdmin = isAdmin
+		u.UpdatedAt = timestamp()
+
+		return ds.record(Record{Op: OpUpdateUser, User: &u})
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	dbStruct.RevokedTokens[token] = time.Now()
+	return u.withoutPassword(), nil
+}
 
-	return db.writeDB(dbStruct)
+// RevokeToken stores a refresh token as revoked until it expires,
+// by hash so the database never holds a usable token
+func (db *DB) RevokeToken(token string, expiresAt time.Time) error {
+	return db.Update(func(ds *DbStructure) error {
+		return ds.record(Record{
+			Op:      OpRevokeToken,
+			Token:   tokenKey(token),
+			Revoked: &RevokedToken{RevokedAt: time.Now(), ExpiresAt: expiresAt},
+		})
+	})
 }
 
 func (db *DB) IsRevoked(token string) (bool, error) {
-	dbStruct, err := db.loadDB()
+	var ok bool
+
+	err := db.View(func(ds *DbStructure) error {
+		_, ok = ds.RevokedTokens[tokenKey(token)]
+
+		return nil
+	})
+
+	return ok, err
+}
+
+// PurgeRevokedTokens forgets revocations of tokens that expired
+// before now, they are rejected for being expired anyway
+func (db *DB) PurgeRevokedTokens(now time.Time) (int, error) {
+	n := 0
+
+	err := db.Update(func(ds *DbStructure) error {
+		for _, t := range ds.RevokedTokens {
+			if t.ExpiresAt.Before(now) {
+				n++
+			}
+		}
+
+		if n == 0 {
+			return nil
+		}
+
+		return ds.record(Record{Op: OpPurgeTokens, Time: now})
+	})
+
+	return n, err
+}
+
+func (db *DB) CountRevokedTokens() (int, error) {
+	var n int
+
+	err := db.View(func(ds *DbStructure) error {
+		n = len(ds.RevokedTokens)
+
+		return nil
+	})
+
+	return n, err
+}
+
+// ensureDB creates a new database file if it doesn't exist,
+// recovers from the last good copy if it is corrupt and
+// migrates it if an older build wrote it
+func (db *DB) ensureDB() error {
+	buf, err := os.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		return db.writeDB(newDbStructure())
+	}
+	if err != nil {
+		return err
+	}
+
+	// only a syntax check, an older schema may not decode into DbStructure
+	if !json.Valid(buf) {
+		log.Printf("%s: %s", ErrCorruptDB, db.path)
+
+		err = db.recoverDB()
+		if err != nil {
+			return err
+		}
+
+		buf, err = os.ReadFile(db.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	version, err := checkVersion(db.path, buf)
+	if err != nil || version == SchemaVersion() {
+		return err
+	}
+
+	from, to, err := migrateJSON(db.path)
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	_, ok := dbStruct.RevokedTokens[token]
+	log.Printf("migrated %s from version %d to %d", db.path, from, to)
 
-	return ok, nil
+	return nil
 }
 
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
-	_, err := os.Stat(db.path)
+// recoverDB replaces a corrupt database file with the last good copy,
+// the corrupt file is moved aside rather than deleted
+func (db *DB) recoverDB() error {
+	buf, err := os.ReadFile(db.backupPath())
 	if os.IsNotExist(err) {
-		_, err = os.Create(db.path)
+		info, statErr := os.Stat(db.path)
+		// a crash between creating and first writing the file
+		if statErr == nil && info.Size() == 0 {
+			log.Printf("%s is empty and has no backup, starting with an empty database", db.path)
+			return db.writeDB(newDbStructure())
+		}
+
+		return fmt.Errorf("%w and no backup exists at %s", ErrCorruptDB, db.backupPath())
+	}
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(buf) {
+		return fmt.Errorf("%w and backup %s is corrupt too", ErrCorruptDB, db.backupPath())
+	}
+
+	corruptPath := fmt.Sprintf("%s.corrupt-%d", db.path, time.Now().Unix())
+	err = os.Rename(db.path, corruptPath)
+	if err != nil {
+		return err
 	}
 
+	err = writeFileAtomic(db.path, "", buf)
 	if err != nil {
 		return err
 	}
 
-	dbStruct := DbStructure{make(map[int]Chirp), make(map[int]User), make(map[string]time.Time)}
-	return db.writeDB(dbStruct)
+	log.Printf("recovered %s from %s, corrupt file moved to %s", db.path, db.backupPath(), corruptPath)
+
+	return nil
 }
 
-// loadDB reads the database file into memory
+// loadDB reads the database file into memory,
+// callers must hold db.mux
 func (db *DB) loadDB() (DbStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
 	ds := DbStructure{}
 
 	buf, err := os.ReadFile(db.path)
@@ -285,42 +813,126 @@ func (db *DB) loadDB() (DbStructure, error) {
 
 	err = json.Unmarshal(buf, &ds)
 	if err != nil {
-		return ds, err
+		return ds, fmt.Errorf("%w: %s: %s", ErrCorruptDB, db.path, err)
 	}
 
+	ds.ensureMaps()
+	ds.buildIndexes()
+
 	return ds, nil
 }
 
-// writeDB writes the database file to disk
+// writeDB atomically replaces the database file on disk,
+// callers must hold db.mux
 func (db *DB) writeDB(ds DbStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
 	buf, err := json.MarshalIndent(ds, "", " ")
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, buf, 0666)
-	if err != nil {
-		return err
+	return writeFileAtomic(db.path, db.backupPath(), buf)
+}
+
+// backupPath is where the last good copy of the database is kept
+func (db *DB) backupPath() string {
+	return db.path + ".bak"
+}
+
+// newDbStructure returns an empty database at the current schema version
+func newDbStructure() DbStructure {
+	ds := DbStructure{
+		Version:   SchemaVersion(),
+		Sequences: &Sequences{},
 	}
+	ds.ensureMaps()
+	ds.buildIndexes()
 
-	return nil
+	return ds
 }
 
-// search
-func (db *DB) search(email string) (User, bool) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return User{}, false
+// ensureMaps allocates the maps omitted from the file when empty
+func (ds *DbStructure) ensureMaps() {
+	if ds.Chirps == nil {
+		ds.Chirps = map[int]Chirp{}
 	}
 
-	for _, u := range dbStruct.Users {
-		if u.Email == email {
-			return u, true
-		}
+	if ds.Users == nil {
+		ds.Users = map[int]User{}
+	}
+
+	if ds.RevokedTokens == nil {
+		ds.RevokedTokens = map[string]RevokedToken{}
+	}
+
+	if ds.Notifications == nil {
+		ds.Notifications = map[int]Notification{}
+	}
+
+	if ds.Likes == nil {
+		ds.Likes = map[int]map[int]time.Time{}
+	}
+
+	if ds.Rechirps == nil {
+		ds.Rechirps = map[int]map[int]time.Time{}
+	}
+
+	if ds.Revisions == nil {
+		ds.Revisions = map[int][]Revision{}
+	}
+
+	if ds.Reports == nil {
+		ds.Reports = map[int]Report{}
+	}
+
+	if ds.ModerationActions == nil {
+		ds.ModerationActions = map[int]ModerationAction{}
 	}
 
-	return User{}, false
+	if ds.Follows == nil {
+		ds.Follows = map[int]map[int]time.Time{}
+	}
+	if ds.Logins == nil {
+		ds.Logins = map[int][]Login{}
+	}
+}
+
+func (ds *DbStructure) nextChirpId() int {
+	ds.Sequences.Chirps++
+
+	return ds.Sequences.Chirps
+}
+
+func (ds *DbStructure) nextUserId() int {
+	ds.Sequences.Users++
+
+	return ds.Sequences.Users
+}
+
+// timestamp is the server time records are stamped with, in UTC
+// and without the monotonic reading so it survives a round trip
+// through either driver unchanged
+func timestamp() time.Time {
+	return time.Now().UTC()
+}
+
+// withoutPassword strips the credentials from a stored user
+// before it is handed out
+func (u User) withoutPassword() User {
+	u.PasswordHash = nil
+
+	return u
+}
+
+// Account returns the view of the user that is safe to send them
+func (u User) Account() Account {
+	return Account{
+		Id:          u.Id,
+		IsChirpyRed: u.IsChirpyRed,
+		IsAdmin:     u.IsAdmin,
+		Email:       u.Email,
+		Handle:      u.Handle,
+		Profile:     u.Profile,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+	}
 }
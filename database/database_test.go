@@ -0,0 +1,2727 @@
+package database
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func newTestDb(t *testing.T, opts Options) *DB {
+	t.Helper()
+
+	return newTestDbAt(t, filepath.Join(t.TempDir(), "db.json"), opts)
+}
+
+func newTestDbAt(t *testing.T, path string, opts Options) *DB {
+	t.Helper()
+
+	db, err := NewDb(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// createTestUsers creates n users, they get the ids 1 to n in a new database
+func createTestUsers(t *testing.T, db Store, n int) {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		_, err := db.CreateUser(fmt.Sprintf("test%d@example.com", i), "password", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var testModes = map[string]Options{
+	"file":         {},
+	"cache sync":   {Cache: true},
+	"cache batch":  {Cache: true, FlushBatch: 10},
+	"cache ticker": {Cache: true, FlushInterval: time.Millisecond},
+	"wal":          {WAL: true, CompactEvery: 10},
+}
+
+func TestConcurrentCreates(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testConcurrentCreates(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testConcurrentCreates(t, newTestSQLiteDb(t))
+	})
+}
+
+func testConcurrentCreates(t *testing.T, db Store) {
+	const n = 25
+
+	author, err := db.CreateUser("author@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := db.CreateChirp(author.Id, fmt.Sprintf("chirp %d", i), 0, nil)
+			errs <- err
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "password", "")
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chirps) != n {
+		t.Errorf("got %d chirps, want %d", len(chirps), n)
+	}
+
+	bodies := map[string]bool{}
+	for _, c := range chirps {
+		bodies[c.Body] = true
+	}
+
+	if len(bodies) != n {
+		t.Errorf("got %d distinct chirps, want %d", len(bodies), n)
+	}
+
+	// every user got an id of their own, one after the other
+	for id := 1; id <= n+1; id++ {
+		_, err = db.GetUser(id)
+		if err != nil {
+			t.Errorf("user %d: %v", id, err)
+		}
+	}
+
+	_, err = db.GetUser(n + 2)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("user %d: %v, want ErrNotFound", n+2, err)
+	}
+}
+
+func TestCacheFlushesOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := NewDb(path, Options{Cache: true, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestUsers(t, db, 1)
+
+	c, err := db.CreateChirp(1, "pending", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewDb(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = reopened.GetChirp(c.Id)
+	if err != nil {
+		t.Fatalf("chirp not flushed on close: %v", err)
+	}
+}
+
+func TestRecoverCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := NewDb(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestUsers(t, db, 1)
+
+	first, err := db.CreateChirp(1, "first", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(1, "second", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last good copy is the database before the second chirp
+	_, err = os.Stat(path + ".bak")
+	if err != nil {
+		t.Fatalf("no backup kept: %v", err)
+	}
+
+	err = os.WriteFile(path, []byte(`{"version": 3, "chirps": {`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := NewDb(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := recovered.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Id != first.Id {
+		t.Fatalf("recovered %+v, want only chirp %d", chirps, first.Id)
+	}
+
+	corrupt, err := filepath.Glob(path + ".corrupt-*")
+	if err != nil || len(corrupt) != 1 {
+		t.Fatalf("corrupt file kept as %v, %v", corrupt, err)
+	}
+
+	// with both copies gone bad there is nothing to recover from
+	for _, p := range []string{path, path + ".bak"} {
+		err = os.WriteFile(p, []byte("{"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = NewDb(path, Options{})
+	if !errors.Is(err, ErrCorruptDB) {
+		t.Fatalf("opening with a corrupt backup: %v, want ErrCorruptDB", err)
+	}
+}
+
+func TestLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := NewDb(path, Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestUsers(t, db, 1)
+
+	first, err := db.CreateChirp(1, "first", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := db.CreateChirp(1, "second", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.DeleteChirp(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash without closing, then tear the last record in half
+	db.log.Close()
+
+	f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":4,"op":"chirp.cre`)
+	f.Close()
+
+	replayed, err := NewDb(path, Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+
+	chirps, err := replayed.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chirps) != 1 || chirps[0].Id != second.Id {
+		t.Fatalf("got %v, want only chirp %d", chirps, second.Id)
+	}
+
+	third, err := replayed.CreateChirp(1, "third", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.Id != second.Id+1 {
+		t.Errorf("got id %d, want %d", third.Id, second.Id+1)
+	}
+}
+
+func TestCompactKeepsSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := NewDb(path, Options{WAL: true, CompactEvery: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTestUsers(t, db, 1)
+
+	// with the user, seven records
+	for i := 0; i < 6; i++ {
+		_, err = db.CreateChirp(1, fmt.Sprintf("chirp %d", i), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three compactions while open and one on close, all segments are kept
+	history := []Record{}
+	for _, seq := range []int{2, 4, 6, 7} {
+		buf, err := os.ReadFile(fmt.Sprintf("%s.log.%d", path, seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		for dec.More() {
+			r := Record{}
+			err = dec.Decode(&r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			history = append(history, r)
+		}
+	}
+
+	if len(history) != 7 || history[0].Op != OpCreateUser {
+		t.Fatalf("history is %+v, want the user and 6 chirps", history)
+	}
+
+	for i, r := range history {
+		if r.Seq != uint64(i+1) {
+			t.Fatalf("record %d has seq %d", i+1, r.Seq)
+		}
+	}
+
+	reopened, err := NewDb(path, Options{WAL: true, CompactEvery: 2, KeepSegments: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	_, err = reopened.CreateChirp(1, "one more", 0, nil)
+	if err == nil {
+		_, err = reopened.CreateChirp(1, "and another", 0, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with a limit only the latest segments are left
+	segments, err := filepath.Glob(path + ".log.*")
+	if err != nil || len(segments) != 1 || segments[0] != path+".log.9" {
+		t.Fatalf("segments are %v, %v, want only %s.log.9", segments, err, path)
+	}
+
+	chirps, err := reopened.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 8 {
+		t.Fatalf("got %d chirps, %v, want 8", len(chirps), err)
+	}
+}
+
+func TestEmailIndex(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testEmailIndex(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testEmailIndex(t, newTestSQLiteDb(t))
+	})
+}
+
+func testEmailIndex(t *testing.T, db Store) {
+	alice, err := db.CreateUser("Alice@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := db.CreateUser("bob@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateUser(" alice@EXAMPLE.com", "password", "")
+	if err != ErrDuplicateEmail {
+		t.Errorf("create: got %v, want %v", err, ErrDuplicateEmail)
+	}
+
+	_, err = db.UpdateUser(bob.Id, "ALICE@example.com", "", "", ProfileUpdate{}, false)
+	if err != ErrDuplicateEmail {
+		t.Errorf("update: got %v, want %v", err, ErrDuplicateEmail)
+	}
+
+	_, err = db.UpdateUser(alice.Id, "carol@example.com", "", "", ProfileUpdate{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Login("alice@example.com", "password")
+	if err != ErrNotFound {
+		t.Errorf("login with old email: got %v, want %v", err, ErrNotFound)
+	}
+
+	u, err := db.Login("Carol@Example.com", "password")
+	if err != nil || u.Id != alice.Id {
+		t.Errorf("login with new email: got %v, %v", u, err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	for name, open := range map[string]func(path string) (Store, error){
+		"json":   func(path string) (Store, error) { return NewDb(path, Options{}) },
+		"sqlite": func(path string) (Store, error) { return NewSQLiteDb(path) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := open(filepath.Join(t.TempDir(), "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			testStore(t, db)
+		})
+	}
+}
+
+// testStore runs through what the handlers ask of every store
+func testStore(t *testing.T, db Store) {
+	alice, err := db.CreateUser("alice@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateUser("alice@example.com", "other", "")
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("creating a user with a taken email: %v, want ErrDuplicateEmail", err)
+	}
+
+	u, err := db.Login("alice@example.com", "password")
+	if err != nil || u.Id != alice.Id || len(u.PasswordHash) != 0 {
+		t.Fatalf("login is %+v (%v)", u, err)
+	}
+
+	_, err = db.Login("alice@example.com", "wrong")
+	if !errors.Is(err, ErrUnAuthorized) {
+		t.Fatalf("login with a wrong password: %v, want ErrUnAuthorized", err)
+	}
+
+	u, err = db.UpdateUser(alice.Id, "", "", "", ProfileUpdate{}, true)
+	if err != nil || !u.IsChirpyRed || u.Email != "alice@example.com" {
+		t.Fatalf("upgraded user is %+v (%v)", u, err)
+	}
+
+	for _, body := range []string{"first", "second"} {
+		_, err = db.CreateChirp(alice.Id, body, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 2 {
+		t.Fatalf("chirps are %+v (%v), want 2", chirps, err)
+	}
+
+	c, err := db.GetChirp(chirps[0].Id)
+	if err != nil || c.AuthorId != alice.Id || (c.Body != "first" && c.Body != "second") {
+		t.Fatalf("chirp is %+v (%v)", c, err)
+	}
+
+	_, err = db.DeleteChirp(c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetChirp(c.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted chirp: %v, want ErrNotFound", err)
+	}
+
+	err = db.RevokeToken("token", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, want := range map[string]bool{"token": true, "other": false} {
+		revoked, err := db.IsRevoked(token)
+		if err != nil || revoked != want {
+			t.Fatalf("%s revoked = %v (%v), want %v", token, revoked, err, want)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		chirps  []int
+		users   []int
+		suspect []int
+		seq     Sequences
+	}{
+		{"empty", nil, nil, nil, Sequences{}},
+		{"no deletes", []int{1, 2, 3}, []int{1, 2}, nil, Sequences{Chirps: 3, Users: 2}},
+		{"deleted last", []int{1, 2}, []int{1}, nil, Sequences{Chirps: 2, Users: 1}},
+		{"deleted in between", []int{1, 3, 4, 6}, []int{1, 2, 3}, []int{3, 4, 6}, Sequences{Chirps: 6, Users: 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := DbStructure{}
+			ds.ensureMaps()
+
+			for _, id := range tc.chirps {
+				ds.Chirps[id] = Chirp{Id: id}
+			}
+			for _, id := range tc.users {
+				ds.Users[id] = User{Id: id}
+			}
+
+			report := ds.repair()
+
+			if !reflect.DeepEqual(report.SuspectIds, tc.suspect) || report.Sequences != tc.seq || *ds.Sequences != tc.seq {
+				t.Fatalf("report is %+v, want suspects %v and sequences %+v", report, tc.suspect, tc.seq)
+			}
+		})
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testBackupRestore(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testBackupRestore(t, newTestSQLiteDb(t))
+	})
+}
+
+func testBackupRestore(t *testing.T, db Store) {
+	alice, err := db.CreateUser("alice@example.com", "password", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "second"} {
+		_, err = db.CreateChirp(alice.Id, body, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backup := bytes.Buffer{}
+	err = db.Backup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := db.CreateUser("bob@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(bob.Id, "after the backup", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, invalid := range map[string]string{
+		"not json":          `{"chirps":`,
+		"future version":    fmt.Sprintf(`{"version": %d}`, SchemaVersion()+1),
+		"chirp under other": strings.Replace(backup.String(), `"1": {`, `"7": {`, 1),
+		"missing reply":     strings.Replace(backup.String(), `"body": "second",`, `"body": "second", "in_reply_to": 9,`, 1),
+	} {
+		err = db.Restore(strings.NewReader(invalid))
+		if !errors.Is(err, ErrInvalidBackup) {
+			t.Fatalf("Restore of %s returned %v, want ErrInvalidBackup", name, err)
+		}
+	}
+
+	// nothing changed after the invalid backups
+	_, err = db.GetChirp(3)
+	if err != nil {
+		t.Fatalf("chirp 3 is gone after an invalid restore: %v", err)
+	}
+
+	err = db.Restore(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 2 || chirps[0].Body != "first" || chirps[1].Body != "second" {
+		t.Fatalf("chirps after restore are %+v (%v)", chirps, err)
+	}
+
+	_, err = db.GetUser(bob.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("bob after restore returned %v, want ErrNotFound", err)
+	}
+
+	// ids handed out after the backup stay used
+	c, err := db.CreateChirp(alice.Id, "after the restore", 0, nil)
+	if err != nil || c.Id != 4 {
+		t.Fatalf("new chirp is %+v (%v), want id 4", c, err)
+	}
+
+	u, err := db.CreateUser("carol@example.com", "password", "")
+	if err != nil || u.Id != bob.Id+1 {
+		t.Fatalf("new user is %+v (%v), want id %d", u, err, bob.Id+1)
+	}
+}
+
+func TestRestoreCompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	db, err := NewDb(path, Options{WAL: true, CompactEvery: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := db.CreateUser("alice@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(alice.Id, "kept", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := bytes.Buffer{}
+	err = db.Backup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(alice.Id, "dropped", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Restore(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path + ".log")
+	if err != nil || info.Size() != 0 {
+		t.Fatalf("log after restore is %v (%v), want it empty", info, err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the older records in the log must not be replayed over the backup
+	db = newTestDbAt(t, path, Options{WAL: true, CompactEvery: 100})
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "kept" {
+		t.Fatalf("chirps after reopening are %+v (%v)", chirps, err)
+	}
+
+	c, err := db.CreateChirp(alice.Id, "new", 0, nil)
+	if err != nil || c.Id != 3 {
+		t.Fatalf("new chirp is %+v (%v), want id 3", c, err)
+	}
+}
+
+func TestPurgeRevokedTokens(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testPurgeRevokedTokens(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testPurgeRevokedTokens(t, newTestSQLiteDb(t))
+	})
+}
+
+func testPurgeRevokedTokens(t *testing.T, db Store) {
+	now := time.Now()
+
+	for token, expiresAt := range map[string]time.Time{
+		"expired": now.Add(-time.Minute),
+		"live":    now.Add(time.Hour),
+	} {
+		err := db.RevokeToken(token, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.PurgeRevokedTokens(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("purged %d tokens, want 1", n)
+	}
+
+	revoked, err := db.IsRevoked("live")
+	if err != nil || !revoked {
+		t.Fatalf("live token revoked = %v, %v, want true", revoked, err)
+	}
+
+	count, err := db.CountRevokedTokens()
+	if err != nil || count != 1 {
+		t.Fatalf("%d revoked tokens, %v, want 1", count, err)
+	}
+}
+
+func TestMigrationRegistry(t *testing.T) {
+	if SchemaVersion() != len(migrations) {
+		t.Fatalf("schema version is %d with %d migrations", SchemaVersion(), len(migrations))
+	}
+
+	names := map[string]bool{}
+	for i, m := range migrations {
+		if m.name == "" || m.up == nil {
+			t.Fatalf("migration %d is incomplete: %+v", i+1, m)
+		}
+		if names[m.name] {
+			t.Fatalf("migration %d reuses the name %q", i+1, m.name)
+		}
+		names[m.name] = true
+	}
+
+	for i, m := range sqliteMigrations {
+		if m == nil {
+			t.Fatalf("sqlite migration %d is missing", i+1)
+		}
+	}
+
+	// a new database starts at the current version
+	db := newTestDb(t, Options{})
+	buf, err := os.ReadFile(db.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := checkVersion(db.path, buf)
+	if err != nil || version != SchemaVersion() {
+		t.Fatalf("new database is at version %d (%v), want %d", version, err, SchemaVersion())
+	}
+}
+
+// oldDatabase is a database from before schema versions
+const oldDatabase = `{
+ "chirps": {
+  "1": {"id": 1, "author_id": 1, "body": "hello #Go"},
+  "3": {"id": 3, "author_id": 1, "body": "after a delete"}
+ },
+ "users": {
+  "1": {"id": 1, "email": "alice@example.com", "password_hash": "aGFzaA=="}
+ },
+ "revoked_tokens": {"old-token": "2024-01-01T00:00:00Z"}
+}`
+
+func writeOldDatabase(t *testing.T, doc string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "db.json")
+
+	err := os.WriteFile(path, []byte(doc), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMigrateJSON(t *testing.T) {
+	path := writeOldDatabase(t, oldDatabase)
+
+	from, to, err := Migrate(DriverJSON, path)
+	if err != nil || from != 0 || to != SchemaVersion() {
+		t.Fatalf("Migrate = %d, %d, %v, want 0, %d", from, to, err, SchemaVersion())
+	}
+
+	backups, err := filepath.Glob(path + ".v0-*")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("backups are %v (%v), want one", backups, err)
+	}
+
+	buf, err := os.ReadFile(backups[0])
+	if err != nil || string(buf) != oldDatabase {
+		t.Fatalf("backup doesn't hold the old database (%v)", err)
+	}
+
+	// already current
+	from, to, err = Migrate(DriverJSON, path)
+	if err != nil || from != to || to != SchemaVersion() {
+		t.Fatalf("second Migrate = %d, %d, %v", from, to, err)
+	}
+
+	db := newTestDbAt(t, path, Options{})
+	testMigratedDatabase(t, db)
+}
+
+func TestMigrateJSONRefuses(t *testing.T) {
+	t.Run("duplicate emails", func(t *testing.T) {
+		doc := `{"users": {
+ "1": {"id": 1, "email": "alice@example.com"},
+ "2": {"id": 2, "email": "Alice@Example.com"}
+}}`
+		path := writeOldDatabase(t, doc)
+
+		_, _, err := Migrate(DriverJSON, path)
+		if err == nil || !strings.Contains(err.Error(), "users 1 and 2 share the email") {
+			t.Fatalf("Migrate error is %v", err)
+		}
+
+		buf, err := os.ReadFile(path)
+		if err != nil || string(buf) != doc {
+			t.Fatalf("database changed after a failed migration (%v)", err)
+		}
+	})
+
+	t.Run("future version", func(t *testing.T) {
+		path := writeOldDatabase(t, fmt.Sprintf(`{"version": %d}`, SchemaVersion()+1))
+
+		_, _, err := Migrate(DriverJSON, path)
+		if !errors.Is(err, ErrFutureSchema) {
+			t.Fatalf("Migrate error is %v, want ErrFutureSchema", err)
+		}
+
+		_, err = NewDb(path, Options{})
+		if !errors.Is(err, ErrFutureSchema) {
+			t.Fatalf("NewDb error is %v, want ErrFutureSchema", err)
+		}
+	})
+
+	t.Run("pending log", func(t *testing.T) {
+		path := writeOldDatabase(t, oldDatabase)
+
+		err := os.WriteFile(path+".log", []byte("{}\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = Migrate(DriverJSON, path)
+		if err == nil || !strings.Contains(err.Error(), "aren't in the snapshot yet") {
+			t.Fatalf("Migrate error is %v", err)
+		}
+	})
+}
+
+func TestOpenMigratesOldSchema(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			path := writeOldDatabase(t, oldDatabase)
+
+			db := newTestDbAt(t, path, opts)
+			testMigratedDatabase(t, db)
+
+			backups, err := filepath.Glob(path + ".v0-*")
+			if err != nil || len(backups) != 1 {
+				t.Fatalf("backups are %v (%v), want one", backups, err)
+			}
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chirpy.db")
+
+		old, err := openSQLite(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the first two versions, before emails were unique ignoring case
+		for version, m := range sqliteMigrations[:2] {
+			tx, err := old.Begin()
+			if err == nil {
+				err = m(tx)
+			}
+			if err == nil {
+				_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = old.Exec(`INSERT INTO users (email, password_hash) VALUES ('Alice@Example.com', 'hash'), (char(9) || 'bob@example.com', 'hash')`)
+		if err == nil {
+			_, err = old.Exec(`INSERT INTO chirps (author_id, body) VALUES (1, 'hello #Go')`)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		old.Close()
+
+		db, err := NewSQLiteDb(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		version, err := sqliteVersion(db.db)
+		if err != nil || version != len(sqliteMigrations) {
+			t.Fatalf("version is %d (%v), want %d", version, err, len(sqliteMigrations))
+		}
+
+		c, err := db.GetChirp(1)
+		if err != nil || c.Body != "hello #Go" || c.AuthorId != 1 {
+			t.Fatalf("chirp 1 is %+v (%v)", c, err)
+		}
+
+		for _, email := range []string{"alice@example.com", "bob@example.com"} {
+			_, err = db.CreateUser(email, "password", "")
+			if !errors.Is(err, ErrDuplicateEmail) {
+				t.Fatalf("CreateUser with the taken email %s returned %v", email, err)
+			}
+		}
+
+		backups, err := filepath.Glob(path + ".v2-*")
+		if err != nil || len(backups) != 1 {
+			t.Fatalf("backups are %v (%v), want one", backups, err)
+		}
+
+		_, err = db.db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(sqliteMigrations)+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		_, err = NewSQLiteDb(path)
+		if !errors.Is(err, ErrFutureSchema) {
+			t.Fatalf("NewSQLiteDb error is %v, want ErrFutureSchema", err)
+		}
+	})
+}
+
+// testMigratedDatabase checks oldDatabase came through the migrations
+func testMigratedDatabase(t *testing.T, db Store) {
+	t.Helper()
+
+	c, err := db.GetChirp(1)
+	if err != nil || c.Body != "hello #Go" || !reflect.DeepEqual(c.Tags, []string{"go"}) || c.CreatedAt.IsZero() {
+		t.Fatalf("chirp 1 is %+v (%v)", c, err)
+	}
+
+	u, err := db.GetUser(1)
+	if err != nil || u.Email != "alice@example.com" || u.CreatedAt.IsZero() {
+		t.Fatalf("user 1 is %+v (%v)", u, err)
+	}
+
+	revoked, err := db.IsRevoked("old-token")
+	if err != nil || !revoked {
+		t.Fatalf("old-token revoked = %v (%v)", revoked, err)
+	}
+
+	// ids continue after the highest one, not after len(map)
+	c, err = db.CreateChirp(1, "new", 0, nil)
+	if err != nil || c.Id != 4 {
+		t.Fatalf("new chirp is %+v (%v), want id 4", c, err)
+	}
+}
+
+func newTestSQLiteDb(t *testing.T) *SQLiteDB {
+	t.Helper()
+
+	db, err := NewSQLiteDb(filepath.Join(t.TempDir(), "chirpy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestChirpPages(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testChirpPages(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testChirpPages(t, newTestSQLiteDb(t))
+	})
+}
+
+func testChirpPages(t *testing.T, db Store) {
+	createTestUsers(t, db, 2)
+
+	for i := 1; i <= 6; i++ {
+		_, err := db.CreateChirp(i%2+1, fmt.Sprintf("chirp %d", i), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.DeleteChirp(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := db.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chirps by id, 3 is gone
+	at := map[int]Chirp{}
+	for _, c := range all {
+		at[c.Id] = c
+	}
+	cur := func(id int) Cursor { return cursorOf(at[id]) }
+
+	for _, tc := range []struct {
+		q    ChirpQuery
+		want []int
+	}{
+		{ChirpQuery{}, []int{1, 2, 4, 5, 6}},
+		{ChirpQuery{Limit: 2}, []int{1, 2}},
+		{ChirpQuery{After: cur(2), Limit: 2}, []int{4, 5}},
+		{ChirpQuery{Before: cur(5), Limit: 2}, []int{2, 4}},
+		{ChirpQuery{Desc: true, Limit: 2}, []int{6, 5}},
+		{ChirpQuery{Desc: true, After: cur(5), Limit: 2}, []int{4, 2}},
+		{ChirpQuery{Desc: true, Before: cur(2), Limit: 2}, []int{5, 4}},
+		{ChirpQuery{After: cur(1), Before: cur(6)}, []int{2, 4, 5}},
+		{ChirpQuery{AuthorId: 2, After: cur(1)}, []int{5}},
+		{ChirpQuery{Sort: SortByCreatedAt}, []int{1, 2, 4, 5, 6}},
+		{ChirpQuery{Sort: SortByCreatedAt, Desc: true, After: cur(5), Limit: 2}, []int{4, 2}},
+		{ChirpQuery{Sort: SortByCreatedAt, Since: at[4].CreatedAt}, []int{4, 5, 6}},
+		{ChirpQuery{Until: at[4].CreatedAt}, []int{1, 2}},
+	} {
+		chirps, err := db.GetChirps(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []int{}
+		for _, c := range chirps {
+			ids = append(ids, c.Id)
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.q, ids, tc.want)
+		}
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testSearchChirps(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testSearchChirps(t, newTestSQLiteDb(t))
+	})
+}
+
+func testSearchChirps(t *testing.T, db Store) {
+	createTestUsers(t, db, 2)
+
+	for i, body := range []string{
+		"Go is fun",           // 1
+		"I like go, go, GO!",  // 2
+		"fun with Go modules", // 3
+		"modules are fun",     // 4
+		"is it going well",    // 5
+	} {
+		_, err := db.CreateChirp(i%2+1, body, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.DeleteChirp(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q    SearchQuery
+		want []int
+	}{
+		{SearchQuery{Text: "go"}, []int{2, 3, 1}},
+		{SearchQuery{Text: "GO fun"}, []int{3, 1}},
+		{SearchQuery{Text: `"go is"`}, []int{1}},
+		{SearchQuery{Text: `"is go"`}, []int{}},
+		{SearchQuery{Text: "modules"}, []int{3}},
+		{SearchQuery{Text: "go", AuthorId: 1}, []int{3, 1}},
+		{SearchQuery{Text: "go", Limit: 1}, []int{2}},
+		{SearchQuery{Text: "nothing"}, []int{}},
+		{SearchQuery{Text: `""`}, []int{}},
+	} {
+		chirps, err := db.SearchChirps(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []int{}
+		for _, c := range chirps {
+			ids = append(ids, c.Id)
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.q, ids, tc.want)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testTags(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testTags(t, newTestSQLiteDb(t))
+	})
+}
+
+func testTags(t *testing.T, db Store) {
+	createTestUsers(t, db, 1)
+
+	for i, body := range []string{
+		"learning #Go today #golang #go", // 1
+		"see a.com/#go and c# and #2024", // 2
+		"#go, #rust!",                    // 3
+		"#rust",                          // 4
+	} {
+		c, err := db.CreateChirp(1, body, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 && fmt.Sprint(c.Tags) != "[go golang]" {
+			t.Errorf("tags of %q are %v", body, c.Tags)
+		}
+	}
+
+	_, err := db.DeleteChirp(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{Tag: "#GO", Desc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []int{}
+	for _, c := range chirps {
+		ids = append(ids, c.Id)
+	}
+
+	if fmt.Sprint(ids) != "[3 1]" {
+		t.Errorf("chirps tagged go are %v, want [3 1]", ids)
+	}
+
+	trending, err := db.TrendingTags(time.Now().Add(-time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(trending) != "[{go 2} {golang 1}]" {
+		t.Errorf("trending tags are %v", trending)
+	}
+
+	trending, err = db.TrendingTags(time.Now().Add(time.Hour), 2)
+	if err != nil || len(trending) != 0 {
+		t.Errorf("trending tags in the future are %v, %v", trending, err)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testMentions(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testMentions(t, newTestSQLiteDb(t))
+	})
+}
+
+func testMentions(t *testing.T, db Store) {
+	alice, err := db.CreateUser("alice@example.com", "password", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := db.CreateUser("bob@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateUser("carol@example.com", "password", "@ALICE")
+	if !errors.Is(err, ErrDuplicateHandle) {
+		t.Fatalf("taking a handle in use: %v, want ErrDuplicateHandle", err)
+	}
+
+	_, err = db.UpdateUser(bob.Id, "", "", "b!", ProfileUpdate{}, false)
+	if !errors.Is(err, ErrInvalidHandle) {
+		t.Fatalf("invalid handle: %v, want ErrInvalidHandle", err)
+	}
+
+	bob, err = db.UpdateUser(bob.Id, "", "", "bob", ProfileUpdate{}, false)
+	if err != nil || bob.Handle != "bob" {
+		t.Fatalf("setting a handle: %+v, %v", bob, err)
+	}
+
+	c1, err := db.CreateChirp(bob.Id, "hi @alice and @nobody, mail bob@alice.com", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(c1.Mentions) != fmt.Sprint([]int{alice.Id}) {
+		t.Errorf("mentions are %v, want [%d]", c1.Mentions, alice.Id)
+	}
+
+	c2, err := db.CreateChirp(alice.Id, "@Bob @alice", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{Mentions: alice.Id})
+	if err != nil || len(chirps) != 2 {
+		t.Fatalf("chirps mentioning alice: %v, %v", chirps, err)
+	}
+
+	// mentioning yourself doesn't notify
+	inbox, err := db.GetNotifications(NotificationQuery{UserId: alice.Id})
+	if err != nil || len(inbox) != 1 || inbox[0].ChirpId != c1.Id || inbox[0].ActorId != bob.Id {
+		t.Fatalf("alice's inbox: %+v, %v", inbox, err)
+	}
+
+	n, err := db.MarkNotificationsRead(alice.Id, nil)
+	if err != nil || n != 1 {
+		t.Fatalf("marked %d read, %v, want 1", n, err)
+	}
+
+	inbox, err = db.GetNotifications(NotificationQuery{UserId: alice.Id, UnreadOnly: true})
+	if err != nil || len(inbox) != 0 {
+		t.Fatalf("alice's unread inbox: %+v, %v", inbox, err)
+	}
+
+	_, err = db.DeleteChirp(c2.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inbox, err = db.GetNotifications(NotificationQuery{UserId: bob.Id})
+	if err != nil || len(inbox) != 0 {
+		t.Fatalf("bob's inbox after the chirp was deleted: %+v, %v", inbox, err)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testReplies(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testReplies(t, newTestSQLiteDb(t))
+	})
+}
+
+func testReplies(t *testing.T, db Store) {
+	createTestUsers(t, db, 3)
+
+	root, err := db.CreateChirp(1, "root", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := db.CreateChirp(2, "reply", root.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nested, err := db.CreateChirp(1, "nested", reply.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := db.CreateChirp(3, "other", root.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(1, "to nowhere", 1000, nil)
+	if !errors.Is(err, ErrInvalidReply) {
+		t.Fatalf("replying to a missing chirp: %v, want ErrInvalidReply", err)
+	}
+
+	thread, err := db.GetThread(nested.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if thread.Id != root.Id || thread.ReplyCount != 3 || len(thread.Replies) != 2 {
+		t.Fatalf("thread is %+v, want root %d with 3 replies", thread, root.Id)
+	}
+	if thread.Replies[0].Id != reply.Id || thread.Replies[1].Id != other.Id || thread.Replies[0].Replies[0].Id != nested.Id {
+		t.Fatalf("replies are nested wrong: %+v", thread.Replies)
+	}
+
+	// a chirp with replies leaves a tombstone
+	_, err = db.DeleteChirp(reply.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetChirp(reply.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("getting a tombstone: %v, want ErrNotFound", err)
+	}
+
+	_, err = db.CreateChirp(1, "to a tombstone", reply.Id, nil)
+	if !errors.Is(err, ErrInvalidReply) {
+		t.Fatalf("replying to a tombstone: %v, want ErrInvalidReply", err)
+	}
+
+	thread, err = db.GetThread(root.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gone := thread.Replies[0]
+	if !gone.Deleted || gone.Body != "" || gone.AuthorId != 0 || len(gone.Replies) != 1 || thread.ReplyCount != 2 {
+		t.Fatalf("thread after deleting a reply is %+v", thread)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 3 {
+		t.Fatalf("chirps with a tombstone: %v, %v", chirps, err)
+	}
+
+	// deleting its last reply takes the tombstone with it
+	_, err = db.DeleteChirp(nested.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread, err = db.GetThread(root.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if thread.ReplyCount != 1 || len(thread.Replies) != 1 || thread.Replies[0].Id != other.Id {
+		t.Fatalf("thread after deleting the nested reply is %+v", thread)
+	}
+
+	_, err = db.GetThread(reply.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("thread of a pruned tombstone: %v, want ErrNotFound", err)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testReactions(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testReactions(t, newTestSQLiteDb(t))
+	})
+}
+
+func testReactions(t *testing.T, db Store) {
+	createTestUsers(t, db, 5)
+
+	c, err := db.CreateChirp(1, "like me", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// double clicks from every user at once
+	var wg sync.WaitGroup
+	for userId := 1; userId <= 5; userId++ {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(userId int) {
+				defer wg.Done()
+
+				_, err := db.AddReaction(ReactionLike, c.Id, userId)
+				if err != nil {
+					t.Error(err)
+				}
+			}(userId)
+		}
+	}
+	wg.Wait()
+
+	c, err = db.AddReaction(ReactionRechirp, c.Id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.LikeCount != 5 || c.RechirpCount != 1 {
+		t.Fatalf("counted %d likes and %d rechirps, want 5 and 1", c.LikeCount, c.RechirpCount)
+	}
+
+	c, err = db.RemoveReaction(ReactionLike, c.Id, 3)
+	if err == nil {
+		c, err = db.RemoveReaction(ReactionLike, c.Id, 3)
+	}
+	if err != nil || c.LikeCount != 4 {
+		t.Fatalf("unliking twice: %+v, %v", c, err)
+	}
+
+	likes, err := db.GetReactions(ReactionQuery{Kind: ReactionLike, ChirpId: c.Id, Limit: 3})
+	if err != nil || len(likes) != 3 {
+		t.Fatalf("first page of likes: %+v, %v", likes, err)
+	}
+
+	last := likes[len(likes)-1]
+	more, err := db.GetReactions(ReactionQuery{Kind: ReactionLike, ChirpId: c.Id, After: Cursor{CreatedAt: last.CreatedAt, Id: last.UserId}})
+	if err != nil || len(more) != 1 {
+		t.Fatalf("second page of likes: %+v, %v", more, err)
+	}
+
+	seen := map[int]bool{}
+	for _, like := range append(likes, more...) {
+		seen[like.UserId] = true
+	}
+	if len(seen) != 4 || seen[3] {
+		t.Fatalf("liked by %v, want everyone but user 3", seen)
+	}
+
+	_, err = db.DeleteChirp(c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddReaction(ReactionLike, c.Id, 1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("liking a deleted chirp: %v, want ErrNotFound", err)
+	}
+}
+
+func TestEdits(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testEdits(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testEdits(t, newTestSQLiteDb(t))
+	})
+}
+
+func testEdits(t *testing.T, db Store) {
+	author, err := db.CreateUser("author@example.com", "password", "author")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, handle := range []string{"ann", "ben"} {
+		_, err = db.CreateUser(handle+"@example.com", "password", handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := db.CreateChirp(author.Id, "hello @ann #first", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddReaction(ReactionLike, c.Id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.EditChirp(c.Id, 2, "not mine", nil, time.Hour)
+	if !errors.Is(err, ErrNotAuthor) {
+		t.Fatalf("editing someone else's chirp: %v, want ErrNotAuthor", err)
+	}
+
+	_, err = db.EditChirp(c.Id, author.Id, "too late", nil, 0)
+	if !errors.Is(err, ErrEditWindowClosed) {
+		t.Fatalf("editing after the window: %v, want ErrEditWindowClosed", err)
+	}
+
+	_, err = db.EditChirp(1000, author.Id, "missing", nil, time.Hour)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("editing a missing chirp: %v, want ErrNotFound", err)
+	}
+
+	edited, err := db.EditChirp(c.Id, author.Id, "hello @ben #second", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if edited.EditedAt == nil || edited.Body != "hello @ben #second" || edited.LikeCount != 1 || !edited.CreatedAt.Equal(c.CreatedAt) {
+		t.Fatalf("edited chirp is %+v", edited)
+	}
+
+	edited, err = db.EditChirp(c.Id, author.Id, "hello @ben #third", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := db.GetRevisions(c.Id)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("revisions: %+v, %v", revisions, err)
+	}
+	if revisions[0].Body != "hello @ann #first" || revisions[1].Body != "hello @ben #second" || !revisions[1].ReplacedAt.Equal(*edited.EditedAt) {
+		t.Fatalf("revisions are %+v", revisions)
+	}
+
+	// the indexes follow the body
+	for tag, want := range map[string]int{"first": 0, "second": 0, "third": 1} {
+		chirps, err := db.GetChirps(ChirpQuery{Tag: tag})
+		if err != nil || len(chirps) != want {
+			t.Errorf("chirps tagged %s: %d, %v, want %d", tag, len(chirps), err, want)
+		}
+	}
+
+	found, err := db.SearchChirps(SearchQuery{Text: "third"})
+	if err != nil || len(found) != 1 {
+		t.Errorf("searching the new body: %v, %v", found, err)
+	}
+
+	// ann was unmentioned, ben notified once
+	for userId, want := range map[int]int{2: 0, 3: 1} {
+		inbox, err := db.GetNotifications(NotificationQuery{UserId: userId})
+		if err != nil || len(inbox) != want {
+			t.Errorf("inbox of user %d: %+v, %v, want %d", userId, inbox, err, want)
+		}
+	}
+
+	_, err = db.DeleteChirp(c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetRevisions(c.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("revisions of a deleted chirp: %v, want ErrNotFound", err)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testModeration(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testModeration(t, newTestSQLiteDb(t))
+	})
+}
+
+func testModeration(t *testing.T, db Store) {
+	for _, email := range []string{"author@example.com", "reporter@example.com", "admin@example.com"} {
+		_, err := db.CreateUser(email, "password", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reported, err := db.CreateChirp(1, "reported #spam", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flagged, err := db.CreateChirp(1, "flagged", 0, []string{"links"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(1, "fine", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := db.ReportChirp(reported.Id, 2, "spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reporting twice keeps the first report
+	again, err := db.ReportChirp(reported.Id, 2, "more spam")
+	if err != nil || again.Id != first.Id || again.Reason != "spam" {
+		t.Fatalf("second report is %+v, %v, want %+v", again, err, first)
+	}
+
+	queue, err := db.GetModerationQueue(QueueQuery{})
+	if err != nil || len(queue) != 2 {
+		t.Fatalf("queue: %+v, %v", queue, err)
+	}
+	if queue[0].Chirp.Id != reported.Id || len(queue[0].Reports) != 1 || queue[1].Chirp.Id != flagged.Id || len(queue[1].Reports) != 0 {
+		t.Fatalf("queue is %+v", queue)
+	}
+
+	hidden, err := db.Moderate(reported.Id, 3, ModerationHide)
+	if err != nil || hidden.AdminId != 3 {
+		t.Fatalf("hiding: %+v, %v", hidden, err)
+	}
+
+	_, err = db.GetChirp(reported.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("hidden chirp: %v, want ErrNotFound", err)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{Tag: "spam"})
+	if err != nil || len(chirps) != 0 {
+		t.Fatalf("chirps tagged spam: %+v, %v", chirps, err)
+	}
+
+	dismissed, err := db.Moderate(flagged.Id, 3, ModerationDismiss)
+	if err != nil || len(dismissed.Flags) != 1 {
+		t.Fatalf("dismissing: %+v, %v", dismissed, err)
+	}
+
+	c, err := db.GetChirp(flagged.Id)
+	if err != nil || len(c.Flags) != 0 {
+		t.Fatalf("dismissed chirp: %+v, %v", c, err)
+	}
+
+	queue, err = db.GetModerationQueue(QueueQuery{})
+	if err != nil || len(queue) != 0 {
+		t.Fatalf("queue after moderating: %+v, %v", queue, err)
+	}
+
+	_, err = db.Moderate(reported.Id, 3, ModerationDelete)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a hidden chirp: %v, want ErrNotFound", err)
+	}
+
+	actions, err := db.GetModerationActions(ModerationActionQuery{Limit: 1})
+	if err != nil || len(actions) != 1 || actions[0].Id != dismissed.Id {
+		t.Fatalf("last action: %+v, %v", actions, err)
+	}
+
+	actions, err = db.GetModerationActions(ModerationActionQuery{After: dismissed.Id})
+	if err != nil || len(actions) != 1 || actions[0].Action != ModerationHide {
+		t.Fatalf("actions before the last: %+v, %v", actions, err)
+	}
+
+	// the closed report is on file, a new one can be filed
+	report, err := db.ReportChirp(flagged.Id, 2, "still spam")
+	if err != nil || report.Id == first.Id {
+		t.Fatalf("new report: %+v, %v", report, err)
+	}
+}
+
+func TestDeletedChirpReports(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testDeletedChirpReports(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testDeletedChirpReports(t, newTestSQLiteDb(t))
+	})
+}
+
+func testDeletedChirpReports(t *testing.T, db Store) {
+	for _, email := range []string{"author@example.com", "reporter@example.com", "admin@example.com"} {
+		_, err := db.CreateUser(email, "password", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := func(body string) Chirp {
+		t.Helper()
+
+		c, err := db.CreateChirp(1, body, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.ReportChirp(c.Id, 2, "spam")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	check := func(when string, wantOpen int, wantClosed int) {
+		t.Helper()
+
+		queue, err := db.GetModerationQueue(QueueQuery{})
+		if err != nil || len(queue) != wantOpen {
+			t.Fatalf("queue %s: %+v, %v, want %d chirps", when, queue, err, wantOpen)
+		}
+
+		open, closed := countReports(t, db)
+		if open != wantOpen || closed != wantClosed {
+			t.Fatalf("%s there are %d open and %d closed reports, want %d and %d", when, open, closed, wantOpen, wantClosed)
+		}
+	}
+
+	deleted := report("deleted")
+	check("after reporting", 1, 0)
+
+	_, err := db.DeleteChirp(deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after the author deleted the chirp", 0, 0)
+
+	// a chirp with replies leaves a tombstone
+	tombstoned := report("tombstoned")
+	_, err = db.CreateChirp(2, "reply", tombstoned.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.DeleteChirp(tombstoned.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after the author deleted a chirp with replies", 0, 0)
+
+	// an admin deleting it closes the report instead
+	moderated := report("moderated")
+	_, err = db.Moderate(moderated.Id, 3, ModerationDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after an admin deleted the chirp", 0, 1)
+
+	report("left behind")
+	_, err = db.DeleteUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after the author deleted their account", 0, 1)
+}
+
+// countReports counts the open and closed reports a store has on file
+func countReports(t *testing.T, db Store) (open int, closed int) {
+	t.Helper()
+
+	var err error
+
+	switch db := db.(type) {
+	case *DB:
+		err = db.View(func(ds *DbStructure) error {
+			for _, r := range ds.Reports {
+				if r.ActionId == 0 {
+					open++
+				} else {
+					closed++
+				}
+			}
+
+			if len(ds.openReports) > open {
+				return fmt.Errorf("%d chirps have open reports, with %d open reports", len(ds.openReports), open)
+			}
+
+			return nil
+		})
+	case *SQLiteDB:
+		err = db.db.QueryRow(`SELECT count(*) - count(action_id), count(action_id) FROM reports`).Scan(&open, &closed)
+	default:
+		t.Fatalf("can't count the reports of a %T", db)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return open, closed
+}
+
+func TestFollows(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testFollows(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testFollows(t, newTestSQLiteDb(t))
+	})
+}
+
+func testFollows(t *testing.T, db Store) {
+	for _, email := range []string{"reader@example.com", "ann@example.com", "ben@example.com", "cat@example.com"} {
+		_, err := db.CreateUser(email, "password", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// chirps by every user, taking turns
+	for i := 0; i < 12; i++ {
+		_, err := db.CreateChirp(i%4+1, fmt.Sprintf("chirp %d", i), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.Follow(1, 1)
+	if !errors.Is(err, ErrFollowSelf) {
+		t.Fatalf("following yourself: %v, want ErrFollowSelf", err)
+	}
+
+	_, err = db.Follow(1, 9)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("following a missing user: %v, want ErrNotFound", err)
+	}
+
+	for _, followeeId := range []int{2, 3, 3} {
+		_, err = db.Follow(1, followeeId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	following, err := db.GetFollows(FollowQuery{UserId: 1, Following: true})
+	if err != nil || len(following) != 2 || following[0].FolloweeId != 3 {
+		t.Fatalf("following: %+v, %v", following, err)
+	}
+
+	followers, err := db.GetFollows(FollowQuery{UserId: 3})
+	if err != nil || len(followers) != 1 || followers[0].FollowerId != 1 {
+		t.Fatalf("followers: %+v, %v", followers, err)
+	}
+
+	// the reader's own chirps and those of ann and ben, newest first
+	var ids []int
+	q := TimelineQuery{UserId: 1, Limit: 4}
+	for {
+		page, err := db.GetTimeline(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range page {
+			ids = append(ids, c.Id)
+		}
+
+		if len(page) < q.Limit {
+			break
+		}
+		q.After = cursorOf(page[len(page)-1])
+	}
+
+	want := []int{11, 10, 9, 7, 6, 5, 3, 2, 1}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Fatalf("timeline is %v, want %v", ids, want)
+	}
+
+	err = db.Unfollow(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeline, err := db.GetTimeline(TimelineQuery{UserId: 1})
+	if err != nil || len(timeline) != 6 {
+		t.Fatalf("timeline after unfollowing: %d chirps, %v", len(timeline), err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testProfiles(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testProfiles(t, newTestSQLiteDb(t))
+	})
+}
+
+func testProfiles(t *testing.T, db Store) {
+	ann, err := db.CreateUser("ann@example.com", "password", "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateUser("ben@example.com", "password", "ben")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, bio, avatar := " Ann ", "chirps a lot", "https://example.com/ann.png"
+
+	_, err = db.UpdateUser(ann.Id, "", "", "", ProfileUpdate{DisplayName: &name, Bio: &bio, AvatarURL: &avatar}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the fields that are set change, "" clears one
+	empty, script := "", "javascript:alert(1)"
+
+	u, err := db.UpdateUser(ann.Id, "", "", "", ProfileUpdate{Bio: &empty}, false)
+	if err != nil || u.DisplayName != "Ann" || u.Bio != "" || u.AvatarURL != avatar {
+		t.Fatalf("profile after clearing the bio: %+v, %v", u.Profile, err)
+	}
+
+	_, err = db.UpdateUser(ann.Id, "", "", "", ProfileUpdate{AvatarURL: &script}, false)
+	if !errors.Is(err, ErrInvalidProfile) {
+		t.Fatalf("avatar %q: %v, want ErrInvalidProfile", script, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = db.CreateChirp(ann.Id, "hi", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.Follow(2, ann.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := db.GetProfile(ann.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Handle != "ann" || p.DisplayName != "Ann" || p.ChirpCount != 3 || p.FollowerCount != 1 || p.FollowingCount != 0 {
+		t.Fatalf("profile is %+v", p)
+	}
+
+	buf, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "email") || strings.Contains(string(buf), "password") {
+		t.Fatalf("profile has credentials: %s", buf)
+	}
+
+	_, err = db.GetProfile(9)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("profile of a missing user: %v, want ErrNotFound", err)
+	}
+}
+
+func TestUserViews(t *testing.T) {
+	// no field of a view may ever carry a credential, whatever it is filled from
+	for _, view := range []any{Account{}, UserProfile{}} {
+		typ := reflect.TypeOf(view)
+		for _, f := range reflect.VisibleFields(typ) {
+			if strings.Contains(strings.ToLower(f.Name+" "+f.Tag.Get("json")), "password") {
+				t.Fatalf("%s.%s can hold a password", typ.Name(), f.Name)
+			}
+		}
+	}
+
+	stored := User{Id: 1, Email: "ann@example.com", PasswordHash: []byte("$2a$10$hash")}
+	assertNoPassword(t, "account of a stored user", stored.Account())
+
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testUserViews(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testUserViews(t, newTestSQLiteDb(t))
+	})
+}
+
+func testUserViews(t *testing.T, db Store) {
+	u, err := db.CreateUser("ann@example.com", "password", "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoPassword(t, "CreateUser", u.Account())
+
+	bio := "chirps a lot"
+
+	u, err = db.UpdateUser(u.Id, "", "new password", "", ProfileUpdate{Bio: &bio}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoPassword(t, "UpdateUser", u.Account())
+
+	u, err = db.Login("ann@example.com", "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoPassword(t, "Login", u.Account())
+
+	u, err = db.SetAdmin("ann@example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoPassword(t, "SetAdmin", u.Account())
+
+	u, err = db.GetUser(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.IsAdmin || !u.IsChirpyRed || u.Bio != bio {
+		t.Fatalf("user is %+v", u)
+	}
+	assertNoPassword(t, "GetUser", u.Account())
+
+	p, err := db.GetProfile(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoPassword(t, "GetProfile", p)
+}
+
+func assertNoPassword(t *testing.T, name string, view any) {
+	t.Helper()
+
+	buf, err := json.Marshal(view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "password") || strings.Contains(string(buf), "$2a$") {
+		t.Fatalf("%s serializes a password: %s", name, buf)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testDeleteUser(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testDeleteUser(t, newTestSQLiteDb(t))
+	})
+}
+
+func testDeleteUser(t *testing.T, db Store) {
+	for _, handle := range []string{"ann", "ben", "cat"} {
+		_, err := db.CreateUser(handle+"@example.com", "password", handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chirp := func(authorId int, body string, inReplyTo int) Chirp {
+		t.Helper()
+
+		c, err := db.CreateChirp(authorId, body, inReplyTo, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	// ben replied to ann's first chirp, her own thread has no one else in it
+	first := chirp(1, "hi @ben", 0)
+	reply := chirp(2, "hi @ann", first.Id)
+	answer := chirp(1, "hi again", reply.Id)
+	own := chirp(1, "a thread", 0)
+	chirp(1, "of my own", own.Id)
+	bens := chirp(2, "liked", 0)
+
+	for _, kind := range []string{ReactionLike, ReactionRechirp} {
+		_, err := db.AddReaction(kind, bens.Id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.AddReaction(ReactionLike, own.Id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Follow(1, 2)
+	if err == nil {
+		_, err = db.Follow(3, 1)
+	}
+	if err == nil {
+		_, err = db.ReportChirp(bens.Id, 1, "spam")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := db.DeleteUser(1)
+	if err != nil || u.Handle != "ann" || len(u.PasswordHash) != 0 {
+		t.Fatalf("deleted %+v, %v", u, err)
+	}
+
+	_, err = db.DeleteUser(1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting twice: %v, want ErrNotFound", err)
+	}
+
+	_, err = db.GetUser(1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted user: %v, want ErrNotFound", err)
+	}
+
+	_, err = db.Login("ann@example.com", "password")
+	if err == nil {
+		t.Fatal("deleted user can log in")
+	}
+
+	// the chirp ben replied to is an anonymous tombstone, the rest is gone
+	thread, err := db.GetThread(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !thread.Deleted || thread.AuthorId != 0 || thread.Body != "" || len(thread.Replies) != 1 || len(thread.Replies[0].Replies) != 0 {
+		t.Fatalf("thread after deleting its author is %+v", thread)
+	}
+
+	for _, id := range []int{answer.Id, own.Id} {
+		_, err = db.GetThread(id)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("thread of chirp %d: %v, want ErrNotFound", id, err)
+		}
+	}
+
+	c, err := db.GetChirp(bens.Id)
+	if err != nil || c.LikeCount != 0 || c.RechirpCount != 0 {
+		t.Fatalf("chirp ann reacted to is %+v, %v", c, err)
+	}
+
+	for _, q := range []FollowQuery{{UserId: 2}, {UserId: 3, Following: true}} {
+		follows, err := db.GetFollows(q)
+		if err != nil || len(follows) != 0 {
+			t.Fatalf("follows %+v after deleting ann: %+v, %v", q, follows, err)
+		}
+	}
+
+	notifications, err := db.GetNotifications(NotificationQuery{UserId: 2})
+	if err != nil || len(notifications) != 0 {
+		t.Fatalf("ben's notifications after deleting ann: %+v, %v", notifications, err)
+	}
+
+	queue, err := db.GetModerationQueue(QueueQuery{})
+	if err != nil || len(queue) != 0 {
+		t.Fatalf("queue after deleting the reporter: %+v, %v", queue, err)
+	}
+
+	// the email and handle are free again, the id is not
+	u, err = db.CreateUser("ann@example.com", "password", "ann")
+	if err != nil || u.Id != 4 {
+		t.Fatalf("signing up again: %+v, %v", u, err)
+	}
+
+	// nothing is left dangling that a restore would trip over
+	buf := bytes.Buffer{}
+	err = db.Backup(&buf)
+	if err == nil {
+		err = db.Restore(&buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testExport(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testExport(t, newTestSQLiteDb(t))
+	})
+}
+
+func testExport(t *testing.T, db Store) {
+	for _, handle := range []string{"ann", "ben"} {
+		_, err := db.CreateUser(handle+"@example.com", "password", handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// flagged, which only admins get to see
+	ids := []int{}
+	for _, body := range []string{"<b>first</b>", "second", "third"} {
+		c, err := db.CreateChirp(1, body, 0, []string{"links"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, c.Id)
+	}
+
+	_, err := db.CreateChirp(2, "not ann's", 0, nil)
+	if err == nil {
+		_, err = db.DeleteChirp(ids[2])
+	}
+	if err == nil {
+		_, err = db.Moderate(ids[1], 2, ModerationHide)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the latest logins are kept
+	for i := 0; i < maxLogins+2; i++ {
+		err = db.RecordLogin(Login{UserId: 1, IP: "127.0.0.1", UserAgent: fmt.Sprintf("agent %d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.RecordLogin(Login{UserId: 9})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("login of a missing user: %v, want ErrNotFound", err)
+	}
+
+	e, err := db.ExportUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Account.Email != "ann@example.com" || len(e.Chirps) != 2 || e.Chirps[0].Id != ids[0] || !e.Chirps[1].Hidden {
+		t.Fatalf("export is %+v", e)
+	}
+
+	for _, c := range e.Chirps {
+		if len(c.Flags) != 0 {
+			t.Fatalf("exported chirp %d has the flags %v", c.Id, c.Flags)
+		}
+	}
+
+	if len(e.Logins) != maxLogins || e.Logins[0].UserAgent != fmt.Sprintf("agent %d", maxLogins+1) || e.Logins[maxLogins-1].UserAgent != "agent 2" {
+		t.Fatalf("exported %d logins from %+v to %+v", len(e.Logins), e.Logins[0], e.Logins[len(e.Logins)-1])
+	}
+
+	buf := bytes.Buffer{}
+	err = e.WriteArchive(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files[f.Name] = string(content)
+	}
+
+	exported := Export{}
+	err = json.Unmarshal([]byte(files["export.json"]), &exported)
+	if err != nil || len(exported.Chirps) != 2 || exported.Chirps[0].Body != "<b>first</b>" || len(exported.Logins) != maxLogins {
+		t.Fatalf("export.json is %s, %v", files["export.json"], err)
+	}
+	if !strings.Contains(files["index.html"], "&lt;b&gt;first&lt;/b&gt;") {
+		t.Fatalf("index.html is %s", files["index.html"])
+	}
+	assertNoPassword(t, "export", e)
+
+	_, err = db.DeleteUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.ExportUser(1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("export of a deleted user: %v, want ErrNotFound", err)
+	}
+
+	buf.Reset()
+	err = db.Backup(&buf)
+	if err == nil {
+		err = db.Restore(&buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileModeReusesLoadedState(t *testing.T) {
+	db := newTestDb(t, Options{})
+
+	alice, err := db.CreateUser("alice@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(alice.Id, "first", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := db.loaded
+	if loaded == nil {
+		t.Fatal("the state written by Update isn't kept")
+	}
+
+	_, err = db.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.loaded != loaded {
+		t.Fatal("an unchanged file was loaded again")
+	}
+
+	// a second process writing the file
+	other := newTestDbAt(t, db.path, Options{})
+	_, err = other.CreateChirp(alice.Id, "second", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 2 {
+		t.Fatalf("chirps after another write are %+v (%v), want 2", chirps, err)
+	}
+
+	if db.loaded == loaded {
+		t.Fatal("a changed file wasn't loaded again")
+	}
+}
+
+func TestFailedUpdateIsDropped(t *testing.T) {
+	db := newTestDb(t, Options{})
+	createTestUsers(t, db, 1)
+
+	_, err := db.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errFailed := errors.New("failed")
+	err = db.Update(func(ds *DbStructure) error {
+		err := ds.record(Record{Op: OpCreateChirp, Chirp: &Chirp{Id: 1, AuthorId: 1, Body: "half done"}})
+		if err != nil {
+			return err
+		}
+
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Update returned %v, want %v", err, errFailed)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil || len(chirps) != 0 {
+		t.Fatalf("chirps after a failed update are %+v (%v), want none", chirps, err)
+	}
+}
+
+func TestThreadWithMissingParent(t *testing.T) {
+	db := newTestDb(t, Options{})
+
+	alice, err := db.CreateUser("alice@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := 0
+	for _, body := range []string{"root", "reply", "nested"} {
+		c, err := db.CreateChirp(alice.Id, body, parent, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = c.Id
+	}
+
+	// a damaged file that lost the root of the thread
+	ds, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delete(ds.Chirps, 1)
+
+	err = db.writeDB(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread, err := db.GetThread(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if thread.Id != 2 || len(thread.Replies) != 1 || thread.Replies[0].Id != 3 {
+		t.Fatalf("thread is %+v, want it to start at chirp 2", thread)
+	}
+}
+
+func TestPublicChirps(t *testing.T) {
+	db := newTestDb(t, Options{})
+
+	alice, err := db.CreateUser("alice@example.com", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := db.CreateChirp(alice.Id, "root", 0, []string{"profanity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(alice.Id, "reply", root.Id, []string{"links"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread, err := db.GetThread(root.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, view := range map[string]any{
+		"chirp":  root.Public(),
+		"chirps": PublicChirps(chirps),
+		"thread": thread.Public(),
+	} {
+		buf, err := json.Marshal(view)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(buf, []byte(`"flags"`)) {
+			t.Errorf("public %s has the flags: %s", name, buf)
+		}
+	}
+
+	// the stored chirps and the queue keep them
+	if len(thread.Chirp.Flags) != 1 || len(thread.Replies[0].Flags) != 1 {
+		t.Fatalf("making the thread public changed it: %+v", thread)
+	}
+
+	queue, err := db.GetModerationQueue(QueueQuery{})
+	if err != nil || len(queue) != 2 || len(queue[0].Chirp.Flags) != 1 {
+		t.Fatalf("queue is %+v (%v)", queue, err)
+	}
+}
+
+func TestDeletedUserCantWrite(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testDeletedUserCantWrite(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testDeletedUserCantWrite(t, newTestSQLiteDb(t))
+	})
+}
+
+func testDeletedUserCantWrite(t *testing.T, db Store) {
+	createTestUsers(t, db, 2)
+
+	c, err := db.CreateChirp(2, "still here", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.DeleteUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what a deleted user's access token can still ask for until it expires
+	for name, write := range map[string]func() error{
+		"chirp": func() error {
+			_, err := db.CreateChirp(1, "from beyond", 0, nil)
+			return err
+		},
+		"edit": func() error {
+			_, err := db.EditChirp(c.Id, 1, "from beyond", nil, time.Hour)
+			return err
+		},
+		"follow": func() error {
+			_, err := db.Follow(1, 2)
+			return err
+		},
+		"like": func() error {
+			_, err := db.AddReaction(ReactionLike, c.Id, 1)
+			return err
+		},
+		"unlike": func() error {
+			_, err := db.RemoveReaction(ReactionLike, c.Id, 1)
+			return err
+		},
+		"report": func() error {
+			_, err := db.ReportChirp(c.Id, 1, "spam")
+			return err
+		},
+	} {
+		err = write()
+		if !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("%s by a deleted user: %v, want ErrUserNotFound", name, err)
+		}
+	}
+
+	backup := bytes.Buffer{}
+	err = db.Backup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Restore(&backup)
+	if err != nil {
+		t.Fatalf("restoring after the deleted user's writes: %v", err)
+	}
+}
+
+func TestLoginUserAgentLength(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testLoginUserAgentLength(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testLoginUserAgentLength(t, newTestSQLiteDb(t))
+	})
+}
+
+func testLoginUserAgentLength(t *testing.T, db Store) {
+	createTestUsers(t, db, 1)
+
+	// two byte characters, the limit falls in the middle of one
+	for _, ua := range []string{"curl/8.0", "x" + strings.Repeat("é", 1000)} {
+		err := db.RecordLogin(Login{UserId: 1, UserAgent: ua})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := db.ExportUser(1)
+	if err != nil || len(e.Logins) != 2 {
+		t.Fatalf("export is %+v (%v), want 2 logins", e, err)
+	}
+
+	if e.Logins[1].UserAgent != "curl/8.0" {
+		t.Errorf("short user agent became %q", e.Logins[1].UserAgent)
+	}
+
+	long := e.Logins[0].UserAgent
+	if len(long) != maxUserAgentLength-1 || !utf8.ValidString(long) {
+		t.Errorf("long user agent kept %d bytes, valid utf-8 %v", len(long), utf8.ValidString(long))
+	}
+}
+
+func TestConcurrentUserUpdates(t *testing.T) {
+	for name, opts := range testModes {
+		t.Run(name, func(t *testing.T) {
+			testConcurrentUserUpdates(t, newTestDb(t, opts))
+		})
+	}
+
+	t.Run("sqlite", func(t *testing.T) {
+		testConcurrentUserUpdates(t, newTestSQLiteDb(t))
+	})
+}
+
+func testConcurrentUserUpdates(t *testing.T, db Store) {
+	const n = 10
+
+	createTestUsers(t, db, n)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+
+	// a profile edit with a new password, hashing it is the slow part,
+	// racing a polka upgrade of the same user
+	for id := 1; id <= n; id++ {
+		wg.Add(2)
+
+		go func(id int) {
+			defer wg.Done()
+
+			bio := fmt.Sprintf("bio %d", id)
+			_, err := db.UpdateUser(id, "", "new password", "", ProfileUpdate{Bio: &bio}, false)
+			errs <- err
+		}(id)
+
+		go func(id int) {
+			defer wg.Done()
+
+			_, err := db.UpdateUser(id, "", "", "", ProfileUpdate{}, true)
+			errs <- err
+		}(id)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id := 1; id <= n; id++ {
+		u, err := db.GetUser(id)
+		if err != nil || !u.IsChirpyRed || u.Bio != fmt.Sprintf("bio %d", id) {
+			t.Errorf("user %d is %+v (%v), want both the upgrade and the bio", id, u, err)
+		}
+	}
+}
+
+// blockWrites makes writing the database at path fail until the returned
+// func is called, a non-empty directory where the last good copy goes
+// can't be removed, not even by root
+func blockWrites(t *testing.T, path string) func() {
+	t.Helper()
+
+	err := os.Remove(path + ".bak")
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(path+".bak", "blocked"), 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		err := os.RemoveAll(path + ".bak")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheWriteFailure(t *testing.T) {
+	t.Run("sync", func(t *testing.T) {
+		db := newTestDb(t, Options{Cache: true})
+		createTestUsers(t, db, 1)
+
+		unblock := blockWrites(t, db.path)
+
+		_, err := db.CreateChirp(1, "lost", 0, nil)
+		if err == nil {
+			t.Fatal("creating a chirp that can't be written succeeded")
+		}
+
+		// the failed change is gone from the cache
+		chirps, err := db.GetChirps(ChirpQuery{})
+		if err != nil || len(chirps) != 0 {
+			t.Fatalf("chirps after a failed write are %+v (%v), want none", chirps, err)
+		}
+
+		unblock()
+
+		c, err := db.CreateChirp(1, "kept", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reopened := newTestDbAt(t, db.path, Options{})
+
+		chirps, err = reopened.GetChirps(ChirpQuery{})
+		if err != nil || len(chirps) != 1 || chirps[0].Id != c.Id || chirps[0].Body != "kept" {
+			t.Fatalf("chirps on disk are %+v (%v), want only %q", chirps, err, "kept")
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		db := newTestDb(t, Options{Cache: true, FlushBatch: 1})
+		createTestUsers(t, db, 1)
+
+		unblock := blockWrites(t, db.path)
+
+		// write-behind, the change is kept and flushed later
+		c, err := db.CreateChirp(1, "pending", 0, nil)
+		if err != nil {
+			t.Fatalf("creating a chirp with a failing flush: %v", err)
+		}
+
+		unblock()
+
+		err = db.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reopened := newTestDbAt(t, db.path, Options{})
+
+		_, err = reopened.GetChirp(c.Id)
+		if err != nil {
+			t.Fatalf("chirp not flushed after the failure: %v", err)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotAuthor        = errors.New("only the author can edit a chirp")
+	ErrEditWindowClosed = errors.New("chirp can no longer be edited")
+)
+
+// Revision is a body a chirp had before it was edited. CreatedAt is
+// when the chirp got the body and ReplacedAt when it was edited away
+type Revision struct {
+	ChirpId    int       `json:"chirp_id"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// edit returns c with a new body and the revision it replaces,
+// mentions are left for the caller to resolve
+func (c Chirp) edit(body string, flags []string, at time.Time) (Chirp, Revision) {
+	rev := Revision{
+		ChirpId:    c.Id,
+		Body:       c.Body,
+		CreatedAt:  c.CreatedAt,
+		ReplacedAt: at,
+	}
+	if c.EditedAt != nil {
+		rev.CreatedAt = *c.EditedAt
+	}
+
+	c.Body = body
+	c.Tags = extractTags(body)
+	c.Flags = flags
+	c.EditedAt = &at
+	c.UpdatedAt = at
+
+	return c, rev
+}
+
+// checkEdit makes sure authorId wrote c and the window
+// to edit it after posting isn't over at now
+func (c Chirp) checkEdit(authorId int, window time.Duration, now time.Time) error {
+	if c.AuthorId != authorId {
+		return ErrNotAuthor
+	}
+
+	if now.Sub(c.CreatedAt) > window {
+		return ErrEditWindowClosed
+	}
+
+	return nil
+}
+
+// unmentioned returns the users before mentions that after doesn't
+func unmentioned(before, after []int) []int {
+	var ids []int
+
+	for _, id := range before {
+		if !containsId(after, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func containsId(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRevisions checks revisions belong to chirps that are there
+func (ds *DbStructure) validateRevisions() error {
+	for chirpId, revisions := range ds.Revisions {
+		if c, ok := ds.Chirps[chirpId]; !ok || c.Deleted {
+			return fmt.Errorf("revisions of the missing chirp %d", chirpId)
+		}
+
+		for _, rev := range revisions {
+			if rev.ChirpId != chirpId {
+				return fmt.Errorf("revision of chirp %d stored under chirp %d", rev.ChirpId, chirpId)
+			}
+		}
+	}
+
+	return nil
+}
+
+// EditChirp replaces the body of a chirp and keeps the one it had as a
+// revision, only its author can and only within window after posting.
+// Users it newly mentions are notified, users it no longer mentions
+// lose the notification
+func (db *DB) EditChirp(id int, authorId int, body string, flags []string, window time.Duration) (Chirp, error) {
+	var c Chirp
+
+	err := db.Update(func(ds *DbStructure) error {
+		err := ds.checkActor(authorId)
+		if err != nil {
+			return err
+		}
+
+		old, ok := ds.Chirps[id]
+		if !ok || !old.visible() {
+			return ErrNotFound
+		}
+
+		now := timestamp()
+
+		err = old.checkEdit(authorId, window, now)
+		if err != nil {
+			return err
+		}
+
+		var rev Revision
+
+		c, rev = old.edit(body, flags, now)
+		c.Mentions = ds.resolveHandles(extractMentions(body))
+
+		err = ds.record(Record{Op: OpEditChirp, Chirp: &c, Revision: &rev})
+		if err != nil {
+			return err
+		}
+
+		for _, n := range mentionNotifications(c, old.Mentions) {
+			n.Id = ds.nextNotificationId()
+
+			err = ds.record(Record{Op: OpCreateNotification, Notification: &n})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return c, nil
+}
+
+// GetRevisions returns the bodies a chirp had before, oldest first
+func (db *DB) GetRevisions(id int) ([]Revision, error) {
+	revisions := []Revision{}
+
+	err := db.View(func(ds *DbStructure) error {
+		if c, ok := ds.Chirps[id]; !ok || !c.visible() {
+			return ErrNotFound
+		}
+
+		revisions = append(revisions, ds.Revisions[id]...)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
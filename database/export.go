@@ -0,0 +1,128 @@
+package database
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// Export is everything a user can take away about themselves
+type Export struct {
+	Account Account `json:"account"`
+	// Chirps are all of their chirps oldest first, hidden ones too,
+	// without the flags only admins see
+	Chirps []Chirp `json:"chirps"`
+	// Logins are their latest logins, newest first
+	Logins     []Login   `json:"logins"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+var exportIndex = template.Must(template.New("index.html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chirpy export of {{.Account.Email}}</title>
+</head>
+<body>
+<h1>Chirpy export of {{.Account.Email}}</h1>
+<p>Exported at {{.ExportedAt.Format "2006-01-02 15:04:05 MST"}}, the same data is in export.json.</p>
+
+<h2>Account</h2>
+<dl>
+<dt>Id</dt><dd>{{.Account.Id}}</dd>
+<dt>Email</dt><dd>{{.Account.Email}}</dd>
+<dt>Handle</dt><dd>{{.Account.Handle}}</dd>
+<dt>Display name</dt><dd>{{.Account.DisplayName}}</dd>
+<dt>Bio</dt><dd>{{.Account.Bio}}</dd>
+<dt>Avatar</dt><dd>{{.Account.AvatarURL}}</dd>
+<dt>Chirpy Red</dt><dd>{{.Account.IsChirpyRed}}</dd>
+<dt>Signed up</dt><dd>{{.Account.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</dd>
+</dl>
+
+<h2>Chirps ({{len .Chirps}})</h2>
+<ul>
+{{range .Chirps}}<li><time>{{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</time> {{.Body}}{{if .Hidden}} (hidden by an admin){{end}}</li>
+{{end}}</ul>
+
+<h2>Logins ({{len .Logins}})</h2>
+<table>
+<tr><th>When</th><th>IP</th><th>Browser</th></tr>
+{{range .Logins}}<tr><td>{{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.IP}}</td><td>{{.UserAgent}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteArchive writes the export to w as a zip of export.json
+// and an index.html to read it in a browser
+func (e Export) WriteArchive(w io.Writer) error {
+	z := zip.NewWriter(w)
+
+	f, err := z.CreateHeader(&zip.FileHeader{Name: "export.json", Method: zip.Deflate, Modified: e.ExportedAt})
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(e, "", " ")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	f, err = z.CreateHeader(&zip.FileHeader{Name: "index.html", Method: zip.Deflate, Modified: e.ExportedAt})
+	if err != nil {
+		return err
+	}
+
+	err = exportIndex.Execute(f, e)
+	if err != nil {
+		return err
+	}
+
+	return z.Close()
+}
+
+// ExportUser collects what the database holds about a user
+func (db *DB) ExportUser(id int) (Export, error) {
+	e := Export{Chirps: []Chirp{}, Logins: []Login{}}
+
+	err := db.View(func(ds *DbStructure) error {
+		u, ok := ds.Users[id]
+		if !ok {
+			return ErrNotFound
+		}
+
+		e.Account = u.Account()
+
+		for _, c := range ds.Chirps {
+			if c.AuthorId == id && !c.Deleted {
+				e.Chirps = append(e.Chirps, c.Public())
+			}
+		}
+
+		logins := ds.Logins[id]
+		for i := len(logins) - 1; i >= 0; i-- {
+			e.Logins = append(e.Logins, logins[i])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Export{}, err
+	}
+
+	sort.Slice(e.Chirps, func(i, j int) bool {
+		return e.Chirps[i].Id < e.Chirps[j].Id
+	})
+
+	e.ExportedAt = timestamp()
+
+	return e, nil
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to a temp file next to path, syncs it
+// and renames it over path, so a crash never leaves a partial file.
+// The previous content of path is kept at backupPath
+func writeFileAtomic(path, backupPath string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	// best effort, only fails if the rename below already happened
+	defer os.Remove(tmp)
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if backupPath != "" {
+		// the rename swaps a new inode in, so a hard link
+		// keeps the last good content around for recovery.
+		// Recovery depends on it, so failing to keep it fails the write
+		err = os.Remove(backupPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove old backup: %w", err)
+		}
+
+		err = os.Link(path, backupPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("keep backup: %w", err)
+		}
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory entry change (create, rename) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
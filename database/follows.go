@@ -0,0 +1,275 @@
+package database
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Follow is a user following another, whose chirps
+// then show up on the follower's timeline
+type Follow struct {
+	FollowerId int       `json:"follower_id"`
+	FolloweeId int       `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// FollowQuery selects a page of the followers of a user, or of the users
+// they follow with Following set, newest first. After is the position of
+// the last follow of the previous page, with the other user's id for the id
+type FollowQuery struct {
+	UserId    int
+	Following bool
+	After     Cursor
+	Limit     int
+}
+
+// TimelineQuery selects a page of the home timeline of a user, their own
+// chirps and those of the users they follow, newest first. After is the
+// position of the last chirp of the previous page
+type TimelineQuery struct {
+	UserId int
+	After  Cursor
+	Limit  int
+}
+
+// other is the user on the far side of f from the user q lists
+func (q FollowQuery) other(f Follow) int {
+	if q.Following {
+		return f.FolloweeId
+	}
+	return f.FollowerId
+}
+
+// followPage orders follows newest first and cuts out the page q asks for
+func followPage(follows []Follow, q FollowQuery) []Follow {
+	sort.Slice(follows, func(i, j int) bool {
+		a := Cursor{CreatedAt: follows[i].CreatedAt, Id: q.other(follows[i])}
+		b := Cursor{CreatedAt: follows[j].CreatedAt, Id: q.other(follows[j])}
+
+		return a.compare(b, SortByCreatedAt) > 0
+	})
+
+	page := []Follow{}
+	for _, f := range follows {
+		cur := Cursor{CreatedAt: f.CreatedAt, Id: q.other(f)}
+		if q.After.Id != 0 && cur.compare(q.After, SortByCreatedAt) >= 0 {
+			continue
+		}
+
+		page = append(page, f)
+		if len(page) == q.Limit {
+			break
+		}
+	}
+
+	return page
+}
+
+// putFollow stores f in Follows and in the followers index
+func (ds *DbStructure) putFollow(f Follow) {
+	if ds.Follows[f.FollowerId] == nil {
+		ds.Follows[f.FollowerId] = map[int]time.Time{}
+	}
+	ds.Follows[f.FollowerId][f.FolloweeId] = f.CreatedAt
+
+	if ds.followers[f.FolloweeId] == nil {
+		ds.followers[f.FolloweeId] = map[int]time.Time{}
+	}
+	ds.followers[f.FolloweeId][f.FollowerId] = f.CreatedAt
+}
+
+func (ds *DbStructure) dropFollow(f Follow) {
+	delete(ds.Follows[f.FollowerId], f.FolloweeId)
+	if len(ds.Follows[f.FollowerId]) == 0 {
+		delete(ds.Follows, f.FollowerId)
+	}
+
+	delete(ds.followers[f.FolloweeId], f.FollowerId)
+	if len(ds.followers[f.FolloweeId]) == 0 {
+		delete(ds.followers, f.FolloweeId)
+	}
+}
+
+// validateFollows checks follows are between two users that are there
+func (ds *DbStructure) validateFollows() error {
+	for followerId, followees := range ds.Follows {
+		for followeeId := range followees {
+			_, followerOk := ds.Users[followerId]
+			_, followeeOk := ds.Users[followeeId]
+
+			if !followerOk || !followeeOk || followerId == followeeId {
+				return fmt.Errorf("user %d follows user %d, one of them is missing or both are the same", followerId, followeeId)
+			}
+		}
+	}
+
+	return nil
+}
+
+// timelineHead is what is left to merge of one author's chirps,
+// oldest first, next is the position of the newest of them
+type timelineHead struct {
+	ids  []int
+	next Cursor
+}
+
+// timelineHeap keeps the author with the newest chirp on top
+type timelineHeap []timelineHead
+
+func (h timelineHeap) Len() int { return len(h) }
+func (h timelineHeap) Less(i, j int) bool {
+	return h[i].next.compare(h[j].next, SortByCreatedAt) > 0
+}
+func (h timelineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *timelineHeap) Push(x any)   { *h = append(*h, x.(timelineHead)) }
+func (h *timelineHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return head
+}
+
+// timeline merges the chirps of the user and everyone they follow
+// off the author index, reading no further back than the page goes
+func (ds *DbStructure) timeline(q TimelineQuery) []Chirp {
+	authors := []int{q.UserId}
+	for followeeId := range ds.Follows[q.UserId] {
+		authors = append(authors, followeeId)
+	}
+
+	h := timelineHeap{}
+	for _, authorId := range authors {
+		authored, ok := ds.authored[authorId]
+		if !ok {
+			continue
+		}
+
+		end := len(authored.byTime)
+		if q.After.Id != 0 {
+			end = ds.search(authored.byTime, q.After, SortByCreatedAt)
+		}
+
+		if end > 0 {
+			ids := authored.byTime[:end]
+			h = append(h, timelineHead{ids: ids, next: cursorOf(ds.Chirps[ids[end-1]])})
+		}
+	}
+	heap.Init(&h)
+
+	chirps := []Chirp{}
+	for h.Len() > 0 && (q.Limit == 0 || len(chirps) < q.Limit) {
+		head := &h[0]
+		last := len(head.ids) - 1
+
+		chirps = append(chirps, ds.Chirps[head.ids[last]])
+
+		if last == 0 {
+			heap.Pop(&h)
+			continue
+		}
+
+		head.ids = head.ids[:last]
+		head.next = cursorOf(ds.Chirps[head.ids[last-1]])
+		heap.Fix(&h, 0)
+	}
+
+	return chirps
+}
+
+// Follow makes a user follow another, following twice changes nothing
+func (db *DB) Follow(followerId int, followeeId int) (Follow, error) {
+	f := Follow{FollowerId: followerId, FolloweeId: followeeId}
+
+	err := db.Update(func(ds *DbStructure) error {
+		if followerId == followeeId {
+			return ErrFollowSelf
+		}
+
+		err := ds.checkActor(followerId)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := ds.Users[followeeId]; !ok {
+			return ErrNotFound
+		}
+
+		if at, ok := ds.Follows[followerId][followeeId]; ok {
+			f.CreatedAt = at
+			return nil
+		}
+
+		f.CreatedAt = timestamp()
+
+		return ds.record(Record{Op: OpFollow, Follow: &f})
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return f, nil
+}
+
+// Unfollow stops a user following another, if they do
+func (db *DB) Unfollow(followerId int, followeeId int) error {
+	return db.Update(func(ds *DbStructure) error {
+		if _, ok := ds.Users[followeeId]; !ok {
+			return ErrNotFound
+		}
+
+		if _, ok := ds.Follows[followerId][followeeId]; !ok {
+			return nil
+		}
+
+		return ds.record(Record{Op: OpUnfollow, Follow: &Follow{FollowerId: followerId, FolloweeId: followeeId}})
+	})
+}
+
+// GetFollows returns a page of the followers of a user or of the users they follow
+func (db *DB) GetFollows(q FollowQuery) ([]Follow, error) {
+	var follows []Follow
+
+	err := db.View(func(ds *DbStructure) error {
+		if _, ok := ds.Users[q.UserId]; !ok {
+			return ErrNotFound
+		}
+
+		if q.Following {
+			for followeeId, at := range ds.Follows[q.UserId] {
+				follows = append(follows, Follow{FollowerId: q.UserId, FolloweeId: followeeId, CreatedAt: at})
+			}
+
+			return nil
+		}
+
+		for followerId, at := range ds.followers[q.UserId] {
+			follows = append(follows, Follow{FollowerId: followerId, FolloweeId: q.UserId, CreatedAt: at})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return followPage(follows, q), nil
+}
+
+// GetTimeline returns a page of the home timeline of a user
+func (db *DB) GetTimeline(q TimelineQuery) ([]Chirp, error) {
+	var chirps []Chirp
+
+	err := db.View(func(ds *DbStructure) error {
+		chirps = ds.timeline(q)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chirps, nil
+}
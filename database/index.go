@@ -0,0 +1,172 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// normalizeEmail is the form emails are compared and indexed in, both
+// drivers use it. Only ASCII is folded, the same as sqlite's lower()
+func normalizeEmail(email string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, strings.TrimSpace(email))
+}
+
+// buildIndexes derives the in-memory indexes from the stored records,
+// afterwards apply keeps them up to date
+func (ds *DbStructure) buildIndexes() {
+	ds.chirps = sortedChirps{byId: make([]int, 0, len(ds.Chirps))}
+	ds.tags = map[string]*sortedChirps{}
+	ds.mentions = map[int]*sortedChirps{}
+	ds.authored = map[int]*sortedChirps{}
+	ds.replies = map[int][]int{}
+	for id, c := range ds.Chirps {
+		if c.InReplyTo != 0 {
+			ds.replies[c.InReplyTo] = append(ds.replies[c.InReplyTo], id)
+		}
+
+		// tombstones are only there to hold their thread together
+		// and hidden chirps only for the record
+		if c.visible() {
+			ds.chirps.byId = append(ds.chirps.byId, id)
+		}
+	}
+	sort.Ints(ds.chirps.byId)
+	for _, ids := range ds.replies {
+		sort.Ints(ids)
+	}
+
+	for _, id := range ds.chirps.byId {
+		authorId := ds.Chirps[id].AuthorId
+		if ds.authored[authorId] == nil {
+			ds.authored[authorId] = &sortedChirps{}
+		}
+
+		ds.authored[authorId].byId = append(ds.authored[authorId].byId, id)
+
+		for _, tag := range ds.Chirps[id].Tags {
+			if ds.tags[tag] == nil {
+				ds.tags[tag] = &sortedChirps{}
+			}
+
+			ds.tags[tag].byId = append(ds.tags[tag].byId, id)
+		}
+
+		for _, userId := range ds.Chirps[id].Mentions {
+			if ds.mentions[userId] == nil {
+				ds.mentions[userId] = &sortedChirps{}
+			}
+
+			ds.mentions[userId].byId = append(ds.mentions[userId].byId, id)
+		}
+	}
+
+	ds.sortByTime(&ds.chirps)
+	for _, tagged := range ds.tags {
+		ds.sortByTime(tagged)
+	}
+	for _, mentioned := range ds.mentions {
+		ds.sortByTime(mentioned)
+	}
+	for _, authored := range ds.authored {
+		ds.sortByTime(authored)
+	}
+
+	ds.inbox = map[int][]int{}
+	for id, n := range ds.Notifications {
+		ds.inbox[n.UserId] = append(ds.inbox[n.UserId], id)
+	}
+	for _, ids := range ds.inbox {
+		sort.Ints(ids)
+	}
+
+	ds.followers = map[int]map[int]time.Time{}
+	for followerId, followees := range ds.Follows {
+		for followeeId, at := range followees {
+			if ds.followers[followeeId] == nil {
+				ds.followers[followeeId] = map[int]time.Time{}
+			}
+
+			ds.followers[followeeId][followerId] = at
+		}
+	}
+
+	ds.openReports = map[int][]int{}
+	for id, r := range ds.Reports {
+		if r.ActionId == 0 {
+			ds.openReports[r.ChirpId] = append(ds.openReports[r.ChirpId], id)
+		}
+	}
+	for _, ids := range ds.openReports {
+		sort.Ints(ids)
+	}
+
+	ds.terms = map[string]postings{}
+	for _, c := range ds.Chirps {
+		if !c.Hidden {
+			ds.indexTerms(c)
+		}
+	}
+
+	ds.emails = make(map[string]int, len(ds.Users))
+	ds.handles = map[string]int{}
+
+	// lowest id wins if a database predating the index has duplicates
+	ids := make([]int, 0, len(ds.Users))
+	for id := range ds.Users {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for _, id := range ids {
+		ds.emails[normalizeEmail(ds.Users[id].Email)] = id
+
+		if handle := ds.Users[id].Handle; handle != "" {
+			ds.handles[handle] = id
+		}
+	}
+}
+
+// sortByTime fills byTime from byId, which has to be sorted already
+func (ds *DbStructure) sortByTime(s *sortedChirps) {
+	s.byTime = append([]int(nil), s.byId...)
+	sort.SliceStable(s.byTime, func(i, j int) bool {
+		return ds.Chirps[s.byTime[i]].CreatedAt.Before(ds.Chirps[s.byTime[j]].CreatedAt)
+	})
+}
+
+// indexUser moves the email and handle indexes over
+// to the new record of a user
+func (ds *DbStructure) indexUser(old, u User) {
+	oldKey := normalizeEmail(old.Email)
+	if id, ok := ds.emails[oldKey]; ok && id == u.Id {
+		delete(ds.emails, oldKey)
+	}
+
+	ds.emails[normalizeEmail(u.Email)] = u.Id
+
+	if id, ok := ds.handles[old.Handle]; ok && id == u.Id {
+		delete(ds.handles, old.Handle)
+	}
+
+	if u.Handle != "" {
+		ds.handles[u.Handle] = u.Id
+	}
+}
+
+// userByEmail finds a user by email, ignoring case
+func (ds *DbStructure) userByEmail(email string) (User, bool) {
+	id, ok := ds.emails[normalizeEmail(email)]
+	if !ok {
+		return User{}, false
+	}
+
+	u, ok := ds.Users[id]
+
+	return u, ok
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLogins is how many logins are kept per user, older ones are dropped
+const maxLogins = 100
+
+// maxUserAgentLength is how many bytes of a user agent are kept,
+// browsers send a few hundred but clients can send anything
+const maxUserAgentLength = 512
+
+// Login is a user signing in and starting a session
+type Login struct {
+	UserId    int       `json:"user_id"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// putLogin adds l to the history of its user, dropping the oldest
+// logins past maxLogins
+func (ds *DbStructure) putLogin(l Login) {
+	logins := append(ds.Logins[l.UserId], l)
+	if len(logins) > maxLogins {
+		logins = append([]Login(nil), logins[len(logins)-maxLogins:]...)
+	}
+
+	ds.Logins[l.UserId] = logins
+}
+
+// truncateUserAgent cuts ua to maxUserAgentLength bytes
+// without splitting a character
+func truncateUserAgent(ua string) string {
+	if len(ua) <= maxUserAgentLength {
+		return ua
+	}
+
+	n := maxUserAgentLength
+	for n > 0 && !utf8.RuneStart(ua[n]) {
+		n--
+	}
+
+	return ua[:n]
+}
+
+// validateLogins checks logins are of users that are there
+func (ds *DbStructure) validateLogins() error {
+	for userId, logins := range ds.Logins {
+		if _, ok := ds.Users[userId]; !ok {
+			return fmt.Errorf("logins of the missing user %d", userId)
+		}
+
+		for _, l := range logins {
+			if l.UserId != userId {
+				return fmt.Errorf("login of user %d stored under user %d", l.UserId, userId)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RecordLogin adds a login to the history of its user
+func (db *DB) RecordLogin(l Login) error {
+	return db.Update(func(ds *DbStructure) error {
+		if _, ok := ds.Users[l.UserId]; !ok {
+			return ErrNotFound
+		}
+
+		l.UserAgent = truncateUserAgent(l.UserAgent)
+		l.CreatedAt = timestamp()
+
+		return ds.record(Record{Op: OpLogin, Login: &l})
+	})
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	minHandleLength = 3
+	maxHandleLength = 20
+)
+
+// NotifyMention is sent to users @mentioned in a chirp
+const NotifyMention = "mention"
+
+// Notification is an event in a user's inbox, ActorId is the
+// user that caused it and ChirpId the chirp it is about, if any
+type Notification struct {
+	Id        int        `json:"id"`
+	UserId    int        `json:"user_id"`
+	Type      string     `json:"type"`
+	ActorId   int        `json:"actor_id"`
+	ChirpId   int        `json:"chirp_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// NotificationQuery selects a page of a user's notifications, newest
+// first. After is the id of the last notification of the previous page
+type NotificationQuery struct {
+	UserId     int
+	UnreadOnly bool
+	After      int
+	Limit      int
+}
+
+func (q NotificationQuery) matches(n Notification) bool {
+	return !q.UnreadOnly || n.ReadAt == nil
+}
+
+// normalizeHandle returns the form handles are stored and looked up
+// in, or "" if handle isn't one. Handles are ASCII so they read the
+// same everywhere they are typed
+func normalizeHandle(handle string) string {
+	handle = strings.ToLower(strings.TrimPrefix(handle, "@"))
+
+	if len(handle) < minHandleLength || len(handle) > maxHandleLength {
+		return ""
+	}
+
+	for _, r := range handle {
+		if r != '_' && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+
+	return handle
+}
+
+// checkHandle normalizes a handle a user picked, empty stays empty
+func checkHandle(handle string) (string, error) {
+	if handle == "" {
+		return "", nil
+	}
+
+	normalized := normalizeHandle(handle)
+	if normalized == "" {
+		return "", ErrInvalidHandle
+	}
+
+	return normalized, nil
+}
+
+// extractMentions returns the distinct @handles in body in the order
+// they first appear. An @ inside a word, as in an email, doesn't count
+func extractMentions(body string) []string {
+	var handles []string
+	seen := map[string]bool{}
+
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && (isTagRune(runes[i-1]) || runes[i-1] == '@' || runes[i-1] == '.' || runes[i-1] == '/')) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && isTagRune(runes[end]) {
+			end++
+		}
+
+		handle := normalizeHandle(string(runes[i+1 : end]))
+		if handle != "" && !seen[handle] {
+			seen[handle] = true
+			handles = append(handles, handle)
+		}
+
+		i = end - 1
+	}
+
+	return handles
+}
+
+// mentionNotifications are the notifications a new or edited chirp
+// sends, skipping the users in notified. Ids are left for the caller
+func mentionNotifications(c Chirp, notified []int) []Notification {
+	var notifications []Notification
+
+	for _, userId := range c.Mentions {
+		if userId == c.AuthorId || containsId(notified, userId) {
+			continue
+		}
+
+		notifications = append(notifications, Notification{
+			UserId:    userId,
+			Type:      NotifyMention,
+			ActorId:   c.AuthorId,
+			ChirpId:   c.Id,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+
+	return notifications
+}
+
+// resolveHandles returns the ids of the users with the given handles,
+// handles nobody has are skipped
+func (ds *DbStructure) resolveHandles(handles []string) []int {
+	var ids []int
+
+	for _, handle := range handles {
+		if id, ok := ds.handles[handle]; ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// indexMentions adds a chirp to the chirps mentioning each of its users
+func (ds *DbStructure) indexMentions(c Chirp) {
+	for _, userId := range c.Mentions {
+		if ds.mentions[userId] == nil {
+			ds.mentions[userId] = &sortedChirps{}
+		}
+
+		ds.insertSorted(ds.mentions[userId], c)
+	}
+}
+
+func (ds *DbStructure) unindexMentions(c Chirp) {
+	for _, userId := range c.Mentions {
+		mentioned, ok := ds.mentions[userId]
+		if !ok {
+			continue
+		}
+
+		ds.removeSorted(mentioned, c)
+		if len(mentioned.byId) == 0 {
+			delete(ds.mentions, userId)
+		}
+	}
+}
+
+// dropChirpNotifications deletes the notifications about a chirp
+// in the inboxes of users, only mentioned users can have any
+func (ds *DbStructure) dropChirpNotifications(chirpId int, userIds []int) {
+	for _, userId := range userIds {
+		ids := ds.inbox[userId][:0]
+
+		for _, id := range ds.inbox[userId] {
+			if ds.Notifications[id].ChirpId == chirpId {
+				delete(ds.Notifications, id)
+				continue
+			}
+
+			ids = append(ids, id)
+		}
+
+		ds.inbox[userId] = ids
+	}
+}
+
+func (ds *DbStructure) nextNotificationId() int {
+	ds.Sequences.Notifications++
+
+	return ds.Sequences.Notifications
+}
+
+// GetNotifications returns a page of a user's notifications, newest first
+func (db *DB) GetNotifications(q NotificationQuery) ([]Notification, error) {
+	notifications := []Notification{}
+
+	err := db.View(func(ds *DbStructure) error {
+		inbox := ds.inbox[q.UserId]
+
+		end := len(inbox)
+		if q.After != 0 {
+			end = sort.SearchInts(inbox, q.After)
+		}
+
+		for i := end - 1; i >= 0; i-- {
+			n := ds.Notifications[inbox[i]]
+			if !q.matches(n) {
+				continue
+			}
+
+			notifications = append(notifications, n)
+			if len(notifications) == q.Limit {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// MarkNotificationsRead marks notifications of a user as read, all of
+// the unread ones if ids is empty. It returns how many it marked
+func (db *DB) MarkNotificationsRead(userId int, ids []int) (int, error) {
+	var unread []int
+
+	err := db.Update(func(ds *DbStructure) error {
+		unread = nil
+
+		wanted := map[int]bool{}
+		for _, id := range ids {
+			wanted[id] = true
+		}
+
+		for _, id := range ds.inbox[userId] {
+			if ds.Notifications[id].ReadAt == nil && (len(ids) == 0 || wanted[id]) {
+				unread = append(unread, id)
+			}
+		}
+
+		if len(unread) == 0 {
+			return nil
+		}
+
+		return ds.record(Record{Op: OpReadNotifications, Time: timestamp(), Id: userId, Ids: unread})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(unread), nil
+}
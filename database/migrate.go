@@ -0,0 +1,287 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+var ErrFutureSchema = errors.New("database schema is newer than this build")
+
+// document is the raw json database, migrations work on it
+// rather than on DbStructure, which only knows the latest schema
+type document map[string]json.RawMessage
+
+// get decodes the value at key into v, leaving v alone if it is missing
+func (doc document) get(key string, v any) error {
+	raw, ok := doc[key]
+	if !ok {
+		return nil
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+func (doc document) set(key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	doc[key] = raw
+
+	return nil
+}
+
+// migration upgrades a json database by one schema version
+type migration struct {
+	name string
+	up   func(doc document) error
+}
+
+// migrations are applied in order, the database is at version n once
+// the first n have run. Only ever append to this list
+var migrations = []migration{
+	{"assign ids from sequences", migrateSequences},
+	{"check emails are unique ignoring case", migrateUniqueEmails},
+	{"store revoked tokens by hash with their expiry", migrateRevokedTokens},
+	{"stamp chirps and users with created and updated times", migrateTimestamps},
+	{"extract hashtags from chirps", migrateTags},
+	{"add handles, mentions and notifications", migrateNothing},
+	{"add replies and tombstones to chirps", migrateNothing},
+	{"add likes and rechirps with counters on chirps", migrateNothing},
+	{"add edits and revisions to chirps", migrateNothing},
+	{"flag chirps for moderation", migrateNothing},
+	{"add reports and a moderation queue", migrateNothing},
+	{"add follows and home timelines", migrateNothing},
+	{"add public profiles to users", migrateNothing},
+	{"keep the login history of users", migrateNothing},
+}
+
+// SchemaVersion is the json schema version this build reads and writes
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// checkVersion returns the schema version of a database,
+// refusing one written by a newer build
+func checkVersion(path string, buf []byte) (int, error) {
+	doc := document{}
+	err := json.Unmarshal(buf, &doc)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %s", ErrCorruptDB, path, err)
+	}
+
+	version := 0
+	err = doc.get("version", &version)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %s", ErrCorruptDB, path, err)
+	}
+
+	return version, compareVersion(path, version, SchemaVersion())
+}
+
+// compareVersion refuses a schema version this build doesn't know,
+// older ones are fine as they can be migrated
+func compareVersion(path string, version, current int) error {
+	if version > current {
+		return fmt.Errorf("%w: %s is at version %d, this build knows up to %d", ErrFutureSchema, path, version, current)
+	}
+
+	return nil
+}
+
+// Migrate upgrades the database at path to the current schema version
+// in place, after copying it next to the original
+func Migrate(driver, path string) (from, to int, err error) {
+	switch driver {
+	case DriverJSON:
+		if path == "" {
+			path = "db.json"
+		}
+		return migrateJSON(path)
+	case DriverSQLite:
+		if path == "" {
+			path = "chirpy.db"
+		}
+		return migrateSQLite(path)
+	default:
+		return 0, 0, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+func migrateJSON(path string) (int, int, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	doc := document{}
+	err = json.Unmarshal(buf, &doc)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %s: %s", ErrCorruptDB, path, err)
+	}
+
+	from := 0
+	err = doc.get("version", &from)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if from > SchemaVersion() {
+		return from, from, compareVersion(path, from, SchemaVersion())
+	}
+
+	if from == SchemaVersion() {
+		return from, from, nil
+	}
+
+	// log records are written in the schema of the build that wrote them
+	info, err := os.Stat(path + ".log")
+	if err == nil && info.Size() > 0 {
+		return from, from, fmt.Errorf("%s.log has records that aren't in the snapshot yet, start and stop the server with -db-wal once to compact it", path)
+	}
+
+	backup := fmt.Sprintf("%s.v%d-%d", path, from, time.Now().Unix())
+	err = writeFileAtomic(backup, "", buf)
+	if err != nil {
+		return from, from, err
+	}
+
+	err = upgrade(doc, from)
+	if err != nil {
+		return from, from, err
+	}
+
+	out, err := json.MarshalIndent(doc, "", " ")
+	if err != nil {
+		return from, from, err
+	}
+
+	err = writeFileAtomic(path, path+".bak", out)
+	if err != nil {
+		return from, from, err
+	}
+
+	return from, SchemaVersion(), nil
+}
+
+// upgrade runs the migrations after version from on doc
+func upgrade(doc document, from int) error {
+	for version := from; version < SchemaVersion(); version++ {
+		m := migrations[version]
+
+		err := m.up(doc)
+		if err != nil {
+			return fmt.Errorf("migration %d, %s: %w", version+1, m.name, err)
+		}
+
+		log.Printf("migrate: %d, %s", version+1, m.name)
+	}
+
+	return doc.set("version", SchemaVersion())
+}
+
+// migrateSequences replaces the len(map)+1 ids with persisted sequences
+// and reports the chirps the old scheme may have overwritten
+func migrateSequences(doc document) error {
+	ds := DbStructure{}
+
+	err := doc.get("chirps", &ds.Chirps)
+	if err == nil {
+		err = doc.get("users", &ds.Users)
+	}
+	if err != nil {
+		return err
+	}
+
+	ds.ensureMaps()
+	report := ds.repair()
+
+	if len(report.SuspectIds) > 0 {
+		log.Printf("repair: chirps %v were created after a delete and may have replaced an earlier chirp", report.SuspectIds)
+	}
+
+	log.Printf("repair: sequences start after chirp %d and user %d", report.Sequences.Chirps, report.Sequences.Users)
+
+	return doc.set("sequences", ds.Sequences)
+}
+
+// migrateUniqueEmails refuses to upgrade a database where two users
+// share an email ignoring case, the old UpdateUser allowed it and
+// only a person can decide which account keeps the address
+func migrateUniqueEmails(doc document) error {
+	users := map[int]User{}
+
+	err := doc.get("users", &users)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	seen := map[string]int{}
+	for _, id := range ids {
+		key := normalizeEmail(users[id].Email)
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("users %d and %d share the email %q, change one of them and run migrate again", other, id, key)
+		}
+		seen[key] = id
+	}
+
+	return nil
+}
+
+// migrateTimestamps stamps records from before timestamps with the time
+// of the migration, when they were made isn't known. They all get the
+// same time, so sorting by it keeps them in id order
+func migrateTimestamps(doc document) error {
+	now := timestamp()
+
+	for _, key := range []string{"chirps", "users"} {
+		records := map[string]map[string]json.RawMessage{}
+
+		err := doc.get(key, &records)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			for _, field := range []string{"created_at", "updated_at"} {
+				if _, ok := r[field]; ok {
+					continue
+				}
+
+				raw, err := json.Marshal(now)
+				if err != nil {
+					return err
+				}
+
+				r[field] = raw
+			}
+		}
+
+		if len(records) > 0 {
+			err = doc.set(key, records)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateNothing is for schema changes that only add fields, the version
+// still goes up so older builds don't drop them on their next write
+func migrateNothing(doc document) error {
+	return nil
+}
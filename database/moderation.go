@@ -0,0 +1,318 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ModerationHide    = "hide"
+	ModerationDelete  = "delete"
+	ModerationDismiss = "dismiss"
+)
+
+// Report is a user asking the admins to look at a chirp
+type Report struct {
+	Id         int       `json:"id"`
+	ChirpId    int       `json:"chirp_id"`
+	ReporterId int       `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+	// ActionId is the moderation action that closed the report, 0 while open
+	ActionId int `json:"action_id,omitempty"`
+}
+
+// ModerationAction is an admin dealing with a chirp, it closes the open
+// reports on it. Flags are the ones the chirp had at the time
+type ModerationAction struct {
+	Id        int       `json:"id"`
+	ChirpId   int       `json:"chirp_id"`
+	AdminId   int       `json:"admin_id"`
+	Action    string    `json:"action"`
+	Flags     []string  `json:"flags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// QueueItem is a chirp waiting for an admin, reported or
+// flagged by a moderation rule, with its open reports
+type QueueItem struct {
+	Chirp   Chirp    `json:"chirp"`
+	Reports []Report `json:"reports"`
+}
+
+// QueueQuery selects a page of the moderation queue, oldest chirp
+// first. After is the id of the last chirp of the previous page
+type QueueQuery struct {
+	After int
+	Limit int
+}
+
+// ModerationActionQuery selects a page of the moderation actions, newest
+// first. After is the id of the last action of the previous page
+type ModerationActionQuery struct {
+	After int
+	Limit int
+}
+
+// Public is the chirp as anyone can see it, the flags
+// are for admins going through the moderation queue
+func (c Chirp) Public() Chirp {
+	c.Flags = nil
+	return c
+}
+
+// PublicChirps is Public for every chirp of a list
+func PublicChirps(chirps []Chirp) []Chirp {
+	public := make([]Chirp, len(chirps))
+	for i, c := range chirps {
+		public[i] = c.Public()
+	}
+
+	return public
+}
+
+// Public is the thread with every chirp in it made public
+func (t Thread) Public() Thread {
+	t.Chirp = t.Chirp.Public()
+
+	replies := make([]Thread, len(t.Replies))
+	for i, reply := range t.Replies {
+		replies[i] = reply.Public()
+	}
+	t.Replies = replies
+
+	return t
+}
+
+// queued reports whether c waits for an admin
+func queued(c Chirp, openReports int) bool {
+	return c.visible() && (openReports > 0 || len(c.Flags) > 0)
+}
+
+func validModeration(action string) bool {
+	return action == ModerationHide || action == ModerationDelete || action == ModerationDismiss
+}
+
+// moderate closes the open reports on the chirp of a and hides it or
+// clears its flags, a delete is recorded on its own after
+func (ds *DbStructure) moderate(a ModerationAction) {
+	ds.ModerationActions[a.Id] = a
+
+	for _, id := range ds.openReports[a.ChirpId] {
+		r := ds.Reports[id]
+		r.ActionId = a.Id
+		ds.Reports[id] = r
+	}
+	delete(ds.openReports, a.ChirpId)
+
+	c, ok := ds.Chirps[a.ChirpId]
+	if !ok || c.Deleted {
+		return
+	}
+
+	switch a.Action {
+	case ModerationHide:
+		ds.unindexChirp(c)
+		c.Hidden = true
+	case ModerationDismiss:
+		c.Flags = nil
+	}
+
+	c.UpdatedAt = a.CreatedAt
+	ds.Chirps[c.Id] = c
+}
+
+// dropOpenReports deletes the open reports on a chirp that is being
+// deleted, the ones an admin closed stay with their action
+func (ds *DbStructure) dropOpenReports(chirpId int) {
+	for _, id := range ds.openReports[chirpId] {
+		delete(ds.Reports, id)
+	}
+	delete(ds.openReports, chirpId)
+}
+
+// validateModeration checks reports and actions are within their
+// sequences and reports are closed by actions that are there
+func (ds *DbStructure) validateModeration() error {
+	for key, a := range ds.ModerationActions {
+		if a.Id != key {
+			return fmt.Errorf("moderation action stored under id %d claims id %d", key, a.Id)
+		}
+
+		if a.Id > ds.Sequences.ModerationActions {
+			return fmt.Errorf("moderation action %d is past the sequence %d", a.Id, ds.Sequences.ModerationActions)
+		}
+
+		if !validModeration(a.Action) {
+			return fmt.Errorf("moderation action %d is the unknown action %q", a.Id, a.Action)
+		}
+	}
+
+	for key, r := range ds.Reports {
+		if r.Id != key {
+			return fmt.Errorf("report stored under id %d claims id %d", key, r.Id)
+		}
+
+		if r.Id > ds.Sequences.Reports {
+			return fmt.Errorf("report %d is past the report sequence %d", r.Id, ds.Sequences.Reports)
+		}
+
+		if _, ok := ds.ModerationActions[r.ActionId]; r.ActionId != 0 && !ok {
+			return fmt.Errorf("report %d is closed by the missing moderation action %d", r.Id, r.ActionId)
+		}
+	}
+
+	return nil
+}
+
+func (ds *DbStructure) nextReportId() int {
+	ds.Sequences.Reports++
+
+	return ds.Sequences.Reports
+}
+
+func (ds *DbStructure) nextModerationActionId() int {
+	ds.Sequences.ModerationActions++
+
+	return ds.Sequences.ModerationActions
+}
+
+// ReportChirp files a report on a chirp, a user with an open
+// report on it already gets that one back
+func (db *DB) ReportChirp(chirpId int, reporterId int, reason string) (Report, error) {
+	var r Report
+
+	err := db.Update(func(ds *DbStructure) error {
+		err := ds.checkActor(reporterId)
+		if err != nil {
+			return err
+		}
+
+		if c, ok := ds.Chirps[chirpId]; !ok || !c.visible() {
+			return ErrNotFound
+		}
+
+		for _, id := range ds.openReports[chirpId] {
+			if ds.Reports[id].ReporterId == reporterId {
+				r = ds.Reports[id]
+				return nil
+			}
+		}
+
+		r = Report{
+			Id:         ds.nextReportId(),
+			ChirpId:    chirpId,
+			ReporterId: reporterId,
+			Reason:     reason,
+			CreatedAt:  timestamp(),
+		}
+
+		return ds.record(Record{Op: OpCreateReport, Report: &r})
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return r, nil
+}
+
+// GetModerationQueue returns a page of the chirps waiting for an admin
+func (db *DB) GetModerationQueue(q QueueQuery) ([]QueueItem, error) {
+	items := []QueueItem{}
+
+	err := db.View(func(ds *DbStructure) error {
+		for _, id := range ds.chirps.byId {
+			c := ds.Chirps[id]
+			if id <= q.After || !queued(c, len(ds.openReports[id])) {
+				continue
+			}
+
+			item := QueueItem{Chirp: c, Reports: []Report{}}
+			for _, reportId := range ds.openReports[id] {
+				item.Reports = append(item.Reports, ds.Reports[reportId])
+			}
+
+			items = append(items, item)
+			if len(items) == q.Limit {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Moderate hides, deletes or dismisses a chirp for an admin and
+// closes the open reports on it
+func (db *DB) Moderate(chirpId int, adminId int, action string) (ModerationAction, error) {
+	var a ModerationAction
+
+	err := db.Update(func(ds *DbStructure) error {
+		if !validModeration(action) {
+			return fmt.Errorf("unknown moderation action %q", action)
+		}
+
+		c, ok := ds.Chirps[chirpId]
+		if !ok || !c.visible() {
+			return ErrNotFound
+		}
+
+		a = ModerationAction{
+			Id:        ds.nextModerationActionId(),
+			ChirpId:   chirpId,
+			AdminId:   adminId,
+			Action:    action,
+			Flags:     c.Flags,
+			CreatedAt: timestamp(),
+		}
+
+		err := ds.record(Record{Op: OpModerateChirp, Action: &a})
+		if err != nil || action != ModerationDelete {
+			return err
+		}
+
+		// after the action closed the reports, so they aren't dropped
+		return ds.deleteChirp(ds.Chirps[chirpId])
+	})
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	return a, nil
+}
+
+// GetModerationActions returns a page of what admins did, newest first
+func (db *DB) GetModerationActions(q ModerationActionQuery) ([]ModerationAction, error) {
+	actions := []ModerationAction{}
+
+	err := db.View(func(ds *DbStructure) error {
+		end := ds.Sequences.ModerationActions
+		if q.After != 0 {
+			end = q.After - 1
+		}
+
+		for id := end; id > 0; id-- {
+			a, ok := ds.ModerationActions[id]
+			if !ok {
+				continue
+			}
+
+			actions = append(actions, a)
+			if len(actions) == q.Limit {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// ChirpSort is the order chirps are paged in
+type ChirpSort string
+
+const (
+	SortById        ChirpSort = "id"
+	SortByCreatedAt ChirpSort = "created_at"
+)
+
+// Cursor is the position of a chirp in either order, ids break ties
+// between chirps created at the same time
+type Cursor struct {
+	CreatedAt time.Time
+	Id        int
+}
+
+func cursorOf(c Chirp) Cursor {
+	return Cursor{CreatedAt: c.CreatedAt, Id: c.Id}
+}
+
+// compare orders two cursors by the given sort
+func (a Cursor) compare(b Cursor, by ChirpSort) int {
+	if by == SortByCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+		if a.CreatedAt.Before(b.CreatedAt) {
+			return -1
+		}
+		return 1
+	}
+
+	return a.Id - b.Id
+}
+
+// ChirpQuery selects a page of chirps. After and Before are positions
+// in the order of the page, so After continues where a page ended in
+// either direction. Since is inclusive, Until exclusive. Zero values
+// leave a field unused
+type ChirpQuery struct {
+	AuthorId int
+	Tag      string
+	Mentions int
+	Sort     ChirpSort
+	Desc     bool
+	After    Cursor
+	Before   Cursor
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// backwards reports whether the page is read from Before towards the
+// start, it is reversed afterwards to keep the requested order
+func (q ChirpQuery) backwards() bool {
+	return q.Before.Id != 0 && q.After.Id == 0
+}
+
+// ascending reports whether the page is read going up the sort order
+func (q ChirpQuery) ascending() bool {
+	return q.Desc == q.backwards()
+}
+
+// bounds are the exclusive range of the page, a zero id meaning unbounded
+func (q ChirpQuery) bounds() (lo, hi Cursor) {
+	if q.Desc {
+		return q.Before, q.After
+	}
+	return q.After, q.Before
+}
+
+func (q ChirpQuery) matches(c Chirp) bool {
+	if q.AuthorId != 0 && c.AuthorId != q.AuthorId {
+		return false
+	}
+
+	if !q.Since.IsZero() && c.CreatedAt.Before(q.Since) {
+		return false
+	}
+
+	return q.Until.IsZero() || c.CreatedAt.Before(q.Until)
+}
+
+// sortedChirps are chirp ids in both orders chirps are paged in
+type sortedChirps struct {
+	byId   []int
+	byTime []int
+}
+
+func (s *sortedChirps) by(sort ChirpSort) []int {
+	if sort == SortByCreatedAt {
+		return s.byTime
+	}
+	return s.byId
+}
+
+// chirpIndex returns the chirp ids the query walks, sorted its way
+func (ds *DbStructure) chirpIndex(q ChirpQuery) []int {
+	if q.Tag != "" {
+		tagged, ok := ds.tags[normalizeTag(q.Tag)]
+		if !ok {
+			return nil
+		}
+
+		return tagged.by(q.Sort)
+	}
+
+	if q.Mentions != 0 {
+		mentioned, ok := ds.mentions[q.Mentions]
+		if !ok {
+			return nil
+		}
+
+		return mentioned.by(q.Sort)
+	}
+
+	if q.AuthorId != 0 {
+		authored, ok := ds.authored[q.AuthorId]
+		if !ok {
+			return nil
+		}
+
+		return authored.by(q.Sort)
+	}
+
+	return ds.chirps.by(q.Sort)
+}
+
+// search returns the position of the first chirp in index at or after cur
+func (ds *DbStructure) search(index []int, cur Cursor, by ChirpSort) int {
+	return sort.Search(len(index), func(i int) bool {
+		return cursorOf(ds.Chirps[index[i]]).compare(cur, by) >= 0
+	})
+}
+
+// indexChirp adds a new chirp to the sorted, author, tag, mention and search indexes
+func (ds *DbStructure) indexChirp(c Chirp) {
+	ds.insertSorted(&ds.chirps, c)
+	ds.indexAuthor(c)
+	ds.indexTags(c)
+	ds.indexMentions(c)
+	ds.indexTerms(c)
+}
+
+// unindexChirp drops a chirp from the sorted, author, tag, mention and search
+// indexes, it has to be called before the chirp is deleted
+func (ds *DbStructure) unindexChirp(c Chirp) {
+	ds.removeSorted(&ds.chirps, c)
+	ds.unindexAuthor(c)
+	ds.unindexTags(c)
+	ds.unindexMentions(c)
+	ds.unindexTerms(c)
+}
+
+// indexAuthor adds a chirp to the chirps of its author
+func (ds *DbStructure) indexAuthor(c Chirp) {
+	if ds.authored[c.AuthorId] == nil {
+		ds.authored[c.AuthorId] = &sortedChirps{}
+	}
+
+	ds.insertSorted(ds.authored[c.AuthorId], c)
+}
+
+func (ds *DbStructure) unindexAuthor(c Chirp) {
+	authored, ok := ds.authored[c.AuthorId]
+	if !ok {
+		return
+	}
+
+	ds.removeSorted(authored, c)
+	if len(authored.byId) == 0 {
+		delete(ds.authored, c.AuthorId)
+	}
+}
+
+func (ds *DbStructure) insertSorted(s *sortedChirps, c Chirp) {
+	s.byId = ds.insertId(s.byId, c, SortById)
+	s.byTime = ds.insertId(s.byTime, c, SortByCreatedAt)
+}
+
+func (ds *DbStructure) removeSorted(s *sortedChirps, c Chirp) {
+	s.byId = ds.removeId(s.byId, c, SortById)
+	s.byTime = ds.removeId(s.byTime, c, SortByCreatedAt)
+}
+
+func (ds *DbStructure) insertId(index []int, c Chirp, by ChirpSort) []int {
+	i := ds.search(index, cursorOf(c), by)
+	if i < len(index) && index[i] == c.Id {
+		return index
+	}
+
+	index = append(index, 0)
+	copy(index[i+1:], index[i:])
+	index[i] = c.Id
+
+	return index
+}
+
+func (ds *DbStructure) removeId(index []int, c Chirp, by ChirpSort) []int {
+	i := ds.search(index, cursorOf(c), by)
+	if i < len(index) && index[i] == c.Id {
+		index = append(index[:i], index[i+1:]...)
+	}
+
+	return index
+}
+
+// chirpPage walks the index from the start of the page and stops
+// once it is full, without looking at chirps outside of it
+func (ds *DbStructure) chirpPage(q ChirpQuery) []Chirp {
+	index := ds.chirpIndex(q)
+	lo, hi := q.bounds()
+
+	start, end := 0, len(index)
+	if lo.Id != 0 {
+		start = ds.search(index, Cursor{CreatedAt: lo.CreatedAt, Id: lo.Id + 1}, q.Sort)
+	}
+	if hi.Id != 0 {
+		end = ds.search(index, hi, q.Sort)
+	}
+
+	// ids start at 1, so a zero id sorts ahead of every chirp at that time
+	if q.Sort == SortByCreatedAt && !q.Since.IsZero() {
+		start = max(start, ds.search(index, Cursor{CreatedAt: q.Since}, q.Sort))
+	}
+	if q.Sort == SortByCreatedAt && !q.Until.IsZero() {
+		end = min(end, ds.search(index, Cursor{CreatedAt: q.Until}, q.Sort))
+	}
+
+	chirps := []Chirp{}
+	for n := 0; n < end-start; n++ {
+		i := start + n
+		if !q.ascending() {
+			i = end - 1 - n
+		}
+
+		c := ds.Chirps[index[i]]
+		if !q.matches(c) {
+			continue
+		}
+
+		chirps = append(chirps, c)
+		if len(chirps) == q.Limit {
+			break
+		}
+	}
+
+	if q.backwards() {
+		reverseChirps(chirps)
+	}
+
+	return chirps
+}
+
+func reverseChirps(chirps []Chirp) {
+	for i, j := 0, len(chirps)-1; i < j; i, j = i+1, j-1 {
+		chirps[i], chirps[j] = chirps[j], chirps[i]
+	}
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+// Profile is what users tell others about themselves
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// ProfileUpdate changes the fields of a profile that are set,
+// setting one to "" clears it
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+}
+
+// UserProfile is the public side of a user, it has
+// nothing that identifies them beyond their handle
+type UserProfile struct {
+	Id     int    `json:"id"`
+	Handle string `json:"handle,omitempty"`
+	Profile
+	IsChirpyRed    bool      `json:"is_chirpy_red"`
+	ChirpCount     int       `json:"chirp_count"`
+	FollowerCount  int       `json:"follower_count"`
+	FollowingCount int       `json:"following_count"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func profileOf(u User) UserProfile {
+	return UserProfile{
+		Id:          u.Id,
+		Handle:      u.Handle,
+		Profile:     u.Profile,
+		IsChirpyRed: u.IsChirpyRed,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+// apply returns p with the changes of update, trimmed
+func (update ProfileUpdate) apply(p Profile) Profile {
+	if update.DisplayName != nil {
+		p.DisplayName = strings.TrimSpace(*update.DisplayName)
+	}
+
+	if update.Bio != nil {
+		p.Bio = strings.TrimSpace(*update.Bio)
+	}
+
+	if update.AvatarURL != nil {
+		p.AvatarURL = strings.TrimSpace(*update.AvatarURL)
+	}
+
+	return p
+}
+
+// check makes sure the profile fits on a profile page
+// and the avatar is something a browser can load
+func (p Profile) check() error {
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("%w: display names are at most %d characters", ErrInvalidProfile, maxDisplayNameLength)
+	}
+
+	if utf8.RuneCountInString(p.Bio) > maxBioLength {
+		return fmt.Errorf("%w: bios are at most %d characters", ErrInvalidProfile, maxBioLength)
+	}
+
+	if p.AvatarURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(p.AvatarURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(p.AvatarURL) > maxAvatarURLLength {
+		return fmt.Errorf("%w: avatar_url must be an http or https URL", ErrInvalidProfile)
+	}
+
+	return nil
+}
+
+// GetProfile returns the public profile of a user
+func (db *DB) GetProfile(id int) (UserProfile, error) {
+	var p UserProfile
+
+	err := db.View(func(ds *DbStructure) error {
+		u, ok := ds.Users[id]
+		if !ok {
+			return ErrNotFound
+		}
+
+		p = profileOf(u)
+		p.FollowerCount = len(ds.followers[id])
+		p.FollowingCount = len(ds.Follows[id])
+		if authored, ok := ds.authored[id]; ok {
+			p.ChirpCount = len(authored.byId)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return UserProfile{}, err
+	}
+
+	return p, nil
+}
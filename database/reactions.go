@@ -0,0 +1,191 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	ReactionLike    = "like"
+	ReactionRechirp = "rechirp"
+)
+
+// Reaction is a user liking or rechirping a chirp, each
+// user reacts to a chirp at most once of each kind
+type Reaction struct {
+	Kind      string    `json:"kind"`
+	ChirpId   int       `json:"chirp_id"`
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionQuery selects a page of the reactions of one kind to a chirp,
+// newest first. After is the position of the last reaction of the
+// previous page, with the user id for the id
+type ReactionQuery struct {
+	Kind    string
+	ChirpId int
+	After   Cursor
+	Limit   int
+}
+
+// countReaction adds n to the counter of a kind of reaction
+func (c *Chirp) countReaction(kind string, n int) {
+	switch kind {
+	case ReactionLike:
+		c.LikeCount += n
+	case ReactionRechirp:
+		c.RechirpCount += n
+	}
+}
+
+// reactionPage orders reactions newest first and cuts out the page q asks for
+func reactionPage(reactions []Reaction, q ReactionQuery) []Reaction {
+	sort.Slice(reactions, func(i, j int) bool {
+		a := Cursor{CreatedAt: reactions[i].CreatedAt, Id: reactions[i].UserId}
+		b := Cursor{CreatedAt: reactions[j].CreatedAt, Id: reactions[j].UserId}
+
+		return a.compare(b, SortByCreatedAt) > 0
+	})
+
+	page := []Reaction{}
+	for _, r := range reactions {
+		cur := Cursor{CreatedAt: r.CreatedAt, Id: r.UserId}
+		if q.After.Id != 0 && cur.compare(q.After, SortByCreatedAt) >= 0 {
+			continue
+		}
+
+		page = append(page, r)
+		if len(page) == q.Limit {
+			break
+		}
+	}
+
+	return page
+}
+
+// reactions returns when each user reacted to each chirp,
+// by chirp id then user id, or nil for an unknown kind
+func (ds *DbStructure) reactions(kind string) map[int]map[int]time.Time {
+	switch kind {
+	case ReactionLike:
+		return ds.Likes
+	case ReactionRechirp:
+		return ds.Rechirps
+	}
+
+	return nil
+}
+
+// putReaction stores r without touching the counters
+func (ds *DbStructure) putReaction(r Reaction) {
+	reactions := ds.reactions(r.Kind)
+	if reactions[r.ChirpId] == nil {
+		reactions[r.ChirpId] = map[int]time.Time{}
+	}
+
+	reactions[r.ChirpId][r.UserId] = r.CreatedAt
+}
+
+// dropReactions deletes the reactions to a chirp that is being deleted
+func (ds *DbStructure) dropReactions(chirpId int) {
+	delete(ds.Likes, chirpId)
+	delete(ds.Rechirps, chirpId)
+}
+
+// validateReactions checks reactions are to chirps that
+// are there and that the counters on chirps add up
+func (ds *DbStructure) validateReactions() error {
+	for _, kind := range []string{ReactionLike, ReactionRechirp} {
+		for chirpId := range ds.reactions(kind) {
+			if c, ok := ds.Chirps[chirpId]; !ok || c.Deleted {
+				return fmt.Errorf("%ss of the missing chirp %d", kind, chirpId)
+			}
+		}
+	}
+
+	for _, c := range ds.Chirps {
+		if c.LikeCount != len(ds.Likes[c.Id]) || c.RechirpCount != len(ds.Rechirps[c.Id]) {
+			return fmt.Errorf("chirp %d has counted its likes or rechirps wrong", c.Id)
+		}
+	}
+
+	return nil
+}
+
+// AddReaction makes a user react to a chirp, reacting twice
+// changes nothing. It returns the chirp with its new counters
+func (db *DB) AddReaction(kind string, chirpId int, userId int) (Chirp, error) {
+	return db.react(OpAddReaction, kind, chirpId, userId)
+}
+
+// RemoveReaction takes back a user's reaction to a chirp, if there is one
+func (db *DB) RemoveReaction(kind string, chirpId int, userId int) (Chirp, error) {
+	return db.react(OpRemoveReaction, kind, chirpId, userId)
+}
+
+func (db *DB) react(op string, kind string, chirpId int, userId int) (Chirp, error) {
+	var c Chirp
+
+	err := db.Update(func(ds *DbStructure) error {
+		reactions := ds.reactions(kind)
+		if reactions == nil {
+			return fmt.Errorf("unknown reaction %q", kind)
+		}
+
+		err := ds.checkActor(userId)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+
+		c, ok = ds.Chirps[chirpId]
+		if !ok || !c.visible() {
+			return ErrNotFound
+		}
+
+		_, reacted := reactions[chirpId][userId]
+		if reacted == (op == OpAddReaction) {
+			return nil
+		}
+
+		err = ds.record(Record{Op: op, Reaction: &Reaction{
+			Kind:      kind,
+			ChirpId:   chirpId,
+			UserId:    userId,
+			CreatedAt: timestamp(),
+		}})
+		c = ds.Chirps[chirpId]
+
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return c, nil
+}
+
+// GetReactions returns a page of the reactions of one kind to a chirp
+func (db *DB) GetReactions(q ReactionQuery) ([]Reaction, error) {
+	var reactions []Reaction
+
+	err := db.View(func(ds *DbStructure) error {
+		if c, ok := ds.Chirps[q.ChirpId]; !ok || !c.visible() {
+			return ErrNotFound
+		}
+
+		for userId, at := range ds.reactions(q.Kind)[q.ChirpId] {
+			reactions = append(reactions, Reaction{Kind: q.Kind, ChirpId: q.ChirpId, UserId: userId, CreatedAt: at})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reactionPage(reactions, q), nil
+}
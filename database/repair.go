@@ -0,0 +1,58 @@
+package database
+
+// RepairReport lists what repair found in a database
+// written before ids were assigned from sequences
+type RepairReport struct {
+	// SuspectIds are chirps created after a delete, the old id
+	// assignment could hand them an id that was still in use,
+	// replacing the chirp stored there
+	SuspectIds []int
+	Sequences  Sequences
+}
+
+// repair starts the sequences after the highest id in use, it is run
+// by the first migration. The old len(map)+1 ids were always stored
+// under their own key, what they got wrong was handing out an id
+// that was still in use after a delete, see SuspectIds
+func (ds *DbStructure) repair() RepairReport {
+	report := RepairReport{}
+
+	seq := Sequences{
+		Chirps: maxKey(ds.Chirps),
+		Users:  maxKey(ds.Users),
+	}
+
+	// with len+1 ids, a gap means a chirp was deleted and any
+	// chirp above it may have been created after the delete
+	gap := 0
+	for id := 1; id < seq.Chirps; id++ {
+		if _, ok := ds.Chirps[id]; !ok {
+			gap = id
+			break
+		}
+	}
+
+	if gap > 0 {
+		for id := gap + 1; id <= seq.Chirps; id++ {
+			if _, ok := ds.Chirps[id]; ok {
+				report.SuspectIds = append(report.SuspectIds, id)
+			}
+		}
+	}
+
+	ds.Sequences = &seq
+	report.Sequences = seq
+
+	return report
+}
+
+func maxKey[V any](m map[int]V) int {
+	max := 0
+	for k := range m {
+		if k > max {
+			max = k
+		}
+	}
+
+	return max
+}
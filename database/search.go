@@ -0,0 +1,203 @@
+package database
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchQuery finds chirps whose body has every word of Text, words in
+// double quotes have to appear next to each other in that order
+type SearchQuery struct {
+	Text     string
+	AuthorId int
+	Limit    int
+}
+
+// postings are the positions a term appears at, per chirp id
+type postings map[int][]int
+
+// tokenize splits text into lowercase words, anything
+// that isn't a letter or a digit separates them
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseSearch returns the distinct words of a query and its phrases,
+// an unterminated quote runs to the end of the query
+func parseSearch(text string) (terms []string, phrases [][]string) {
+	seen := map[string]bool{}
+
+	for i, part := range strings.Split(text, `"`) {
+		words := tokenize(part)
+
+		// odd parts are between quotes
+		if i%2 == 1 && len(words) > 1 {
+			phrases = append(phrases, words)
+		}
+
+		for _, w := range words {
+			if !seen[w] {
+				seen[w] = true
+				terms = append(terms, w)
+			}
+		}
+	}
+
+	return terms, phrases
+}
+
+// chirpTerms is what the search index holds for a chirp
+func chirpTerms(c Chirp) map[string][]int {
+	terms := map[string][]int{}
+	for pos, term := range tokenize(c.Body) {
+		terms[term] = append(terms[term], pos)
+	}
+
+	return terms
+}
+
+// rankSearch scores the chirps that have every term and phrase, rarer
+// terms weigh more and repeats less with each one. Ids are returned best
+// match first, newer chirps first between equal scores. Both drivers
+// rank with it so results don't depend on the database
+func rankSearch(terms []string, phrases [][]string, index map[string]postings, total int) []int {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	idf := map[string]float64{}
+	for _, term := range terms {
+		if len(index[term]) == 0 {
+			return nil
+		}
+
+		idf[term] = math.Log(1 + float64(total)/float64(len(index[term])))
+	}
+
+	scores := map[int]float64{}
+
+	// every chirp has the rarest term, start from those
+	rarest := terms[0]
+	for _, term := range terms {
+		if len(index[term]) < len(index[rarest]) {
+			rarest = term
+		}
+	}
+
+candidates:
+	for id := range index[rarest] {
+		score := 0.0
+		for _, term := range terms {
+			tf := len(index[term][id])
+			if tf == 0 {
+				continue candidates
+			}
+
+			score += (1 + math.Log(float64(tf))) * idf[term]
+		}
+
+		for _, phrase := range phrases {
+			n := phraseCount(phrase, index, id)
+			if n == 0 {
+				continue candidates
+			}
+
+			for _, term := range phrase {
+				score += float64(n) * idf[term]
+			}
+		}
+
+		scores[id] = score
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j]
+	})
+
+	return ids
+}
+
+// phraseCount counts the places the words of phrase follow each other in a chirp
+func phraseCount(phrase []string, index map[string]postings, id int) int {
+	n := 0
+
+starts:
+	for _, start := range index[phrase[0]][id] {
+		for offset, term := range phrase[1:] {
+			if !hasPosition(index[term][id], start+offset+1) {
+				continue starts
+			}
+		}
+
+		n++
+	}
+
+	return n
+}
+
+// hasPosition looks for pos in positions, which are sorted
+func hasPosition(positions []int, pos int) bool {
+	i := sort.SearchInts(positions, pos)
+
+	return i < len(positions) && positions[i] == pos
+}
+
+// indexTerms adds a chirp to the search index
+func (ds *DbStructure) indexTerms(c Chirp) {
+	for term, positions := range chirpTerms(c) {
+		if ds.terms[term] == nil {
+			ds.terms[term] = postings{}
+		}
+
+		ds.terms[term][c.Id] = positions
+	}
+}
+
+func (ds *DbStructure) unindexTerms(c Chirp) {
+	for term := range chirpTerms(c) {
+		delete(ds.terms[term], c.Id)
+		if len(ds.terms[term]) == 0 {
+			delete(ds.terms, term)
+		}
+	}
+}
+
+// SearchChirps returns the chirps matching q, best match first
+func (db *DB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	terms, phrases := parseSearch(q.Text)
+
+	chirps := []Chirp{}
+
+	err := db.View(func(ds *DbStructure) error {
+		for _, id := range rankSearch(terms, phrases, ds.terms, len(ds.chirps.byId)) {
+			c := ds.Chirps[id]
+			if q.AuthorId != 0 && c.AuthorId != q.AuthorId {
+				continue
+			}
+
+			chirps = append(chirps, c)
+			if len(chirps) == q.Limit {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chirps, nil
+}
@@ -0,0 +1,877 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDB is a Store backed by a sqlite database file,
+// rows are read and written individually instead of
+// rewriting the whole dataset on every request
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+// sqliteMigration upgrades a sqlite database by one schema version
+type sqliteMigration func(tx *sql.Tx) error
+
+// execSQL is a migration made of plain statements
+func execSQL(query string) sqliteMigration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// sqliteMigrations are applied in order and tracked in PRAGMA user_version,
+// the database is at version n once the first n have run.
+// Only ever append to this list
+var sqliteMigrations = []sqliteMigration{
+	execSQL(`
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL UNIQUE,
+	password_hash BLOB    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body      TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	token      TEXT     PRIMARY KEY,
+	revoked_at DATETIME NOT NULL
+);
+`),
+	execSQL(`ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;`),
+	execSQL(`
+ALTER TABLE users ADD COLUMN email_key TEXT;
+UPDATE users SET email_key = lower(trim(email));
+CREATE UNIQUE INDEX users_email_key ON users (email_key);
+`),
+	migrateSQLiteRevokedTokens,
+	migrateSQLiteTimestamps,
+	migrateSQLiteSearch,
+	migrateSQLiteTags,
+	migrateSQLiteMentions,
+	migrateSQLiteReplies,
+	migrateSQLiteReactions,
+	migrateSQLiteEdits,
+	execSQL(`ALTER TABLE chirps ADD COLUMN flags TEXT NOT NULL DEFAULT '';`),
+	migrateSQLiteModeration,
+	migrateSQLiteFollows,
+	execSQL(`
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+`),
+	migrateSQLiteUserCleanup,
+	migrateSQLiteLogins,
+	migrateSQLiteEmailKeys,
+}
+
+// NewSQLiteDb opens the sqlite database at path, creating the schema
+// for a new database, migrating an older one and refusing a newer one
+func NewSQLiteDb(path string) (*SQLiteDB, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := sqliteVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	fresh, err := sqliteIsEmpty(db)
+	if err == nil && fresh {
+		err = applySQLiteMigrations(db, 0)
+	} else if err == nil && version < len(sqliteMigrations) {
+		err = upgradeSQLite(db, path, version)
+		if err == nil {
+			log.Printf("migrated %s from version %d to %d", path, version, len(sqliteMigrations))
+		}
+	} else if err == nil {
+		err = compareVersion(path, version, len(sqliteMigrations))
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteDB{db}, nil
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	// transactions take the write lock when they begin, a read that
+	// is later written back can't be interleaved with another process
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows a single writer, serialize access
+	// instead of surfacing SQLITE_BUSY to the handlers
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+func sqliteVersion(db *sql.DB) (int, error) {
+	var version int
+
+	err := db.QueryRow(`PRAGMA user_version`).Scan(&version)
+
+	return version, err
+}
+
+// sqliteIsEmpty reports whether the database has no tables yet
+func sqliteIsEmpty(db *sql.DB) (bool, error) {
+	var n int
+
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&n)
+
+	return n == 0, err
+}
+
+// applySQLiteMigrations runs every migration after version from,
+// each in its own transaction together with its version bump
+func applySQLiteMigrations(db *sql.DB, from int) error {
+	for version := from; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		err = sqliteMigrations[version](tx)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", version+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateSQLite upgrades the database at path in place,
+// after writing a copy of it with VACUUM INTO
+func migrateSQLite(path string) (int, int, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+
+	from, err := sqliteVersion(db)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if from >= len(sqliteMigrations) {
+		return from, from, compareVersion(path, from, len(sqliteMigrations))
+	}
+
+	err = upgradeSQLite(db, path, from)
+	if err != nil {
+		return from, from, err
+	}
+
+	return from, len(sqliteMigrations), nil
+}
+
+// upgradeSQLite copies the database next to path with VACUUM INTO
+// and then runs the migrations after version from
+func upgradeSQLite(db *sql.DB, path string, from int) error {
+	backup := fmt.Sprintf("%s.v%d-%d", path, from, time.Now().Unix())
+	_, err := db.Exec(`VACUUM INTO ?`, backup)
+	if err != nil {
+		return err
+	}
+
+	return applySQLiteMigrations(db, from)
+}
+
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// CreateChirp creates a new chirp and saves it to disk
+func (s *SQLiteDB) CreateChirp(authorId int, body string, inReplyTo int, flags []string) (Chirp, error) {
+	now := timestamp()
+
+	c := Chirp{
+		AuthorId:  authorId,
+		Body:      body,
+		Tags:      extractTags(body),
+		InReplyTo: inReplyTo,
+		Flags:     flags,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	err = checkActor(tx, authorId)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	if inReplyTo != 0 {
+		err = checkReply(tx, inReplyTo)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	c.Mentions, err = resolveHandles(tx, extractMentions(body))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	c.Id, err = insertChirp(tx, c)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	for _, n := range mentionNotifications(c, nil) {
+		err = insertNotification(tx, n)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	return c, tx.Commit()
+}
+
+// insertChirp stores c and what the indexes need to find it,
+// with a new id unless it has one
+func insertChirp(tx *sql.Tx, c Chirp) (int, error) {
+	var editedAt any
+	if c.EditedAt != nil {
+		editedAt = c.EditedAt.UnixNano()
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO chirps (`+chirpColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		nullInt(c.Id), c.AuthorId, c.Body, joinTags(c.Tags), joinIds(c.Mentions), nullInt(c.InReplyTo), c.Deleted,
+		c.LikeCount, c.RechirpCount, c.CreatedAt.UnixNano(), c.UpdatedAt.UnixNano(), editedAt, joinTags(c.Flags), c.Hidden,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	lastId, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	c.Id = int(lastId)
+
+	// hidden chirps are kept out of listings, tags and search
+	if c.Hidden {
+		return c.Id, nil
+	}
+
+	err = insertChirpTerms(tx, c)
+	if err == nil {
+		err = insertChirpTags(tx, c)
+	}
+	if err == nil {
+		err = insertChirpMentions(tx, c)
+	}
+
+	return c.Id, err
+}
+
+// unindexChirp deletes what the indexes need to find a chirp
+func unindexChirp(tx *sql.Tx, id int) error {
+	for _, table := range []string{"chirp_terms", "chirp_tags", "chirp_mentions"} {
+		_, err := tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ?`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetChirps returns a page of chirps in the order of q.Sort, reading
+// only the rows of the page off the matching index
+func (s *SQLiteDB) GetChirps(q ChirpQuery) ([]Chirp, error) {
+	where := []string{"deleted = 0", "hidden = 0"}
+	args := []any{}
+
+	dir := "ASC"
+	if !q.ascending() {
+		dir = "DESC"
+	}
+
+	lo, hi := q.bounds()
+	order := "id " + dir
+
+	if q.Sort == SortByCreatedAt {
+		order = "created_at " + dir + ", id " + dir
+
+		if lo.Id != 0 {
+			where = append(where, "(created_at, id) > (?, ?)")
+			args = append(args, lo.CreatedAt.UnixNano(), lo.Id)
+		}
+		if hi.Id != 0 {
+			where = append(where, "(created_at, id) < (?, ?)")
+			args = append(args, hi.CreatedAt.UnixNano(), hi.Id)
+		}
+	} else {
+		if lo.Id != 0 {
+			where = append(where, "id > ?")
+			args = append(args, lo.Id)
+		}
+		if hi.Id != 0 {
+			where = append(where, "id < ?")
+			args = append(args, hi.Id)
+		}
+	}
+
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.AuthorId != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, q.AuthorId)
+	}
+	if q.Tag != "" {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_tags WHERE tag = ?)")
+		args = append(args, normalizeTag(q.Tag))
+	}
+	if q.Mentions != 0 {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)")
+		args = append(args, q.Mentions)
+	}
+
+	query := `SELECT ` + chirpColumns + ` FROM chirps WHERE ` + strings.Join(where, " AND ") + ` ORDER BY ` + order
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		chirps = append(chirps, c)
+	}
+
+	if q.backwards() {
+		reverseChirps(chirps)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (s *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	c, err := scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return c, nil
+}
+
+// DeleteChirp deletes a chirp, one that has replies is left as a tombstone
+func (s *SQLiteDB) DeleteChirp(id int) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	c, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = deleteChirp(tx, c)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return c, tx.Commit()
+}
+
+// deleteChirp deletes c, leaving a tombstone if it has replies. Its
+// open reports go too, the ones an admin closed stay with their action
+func deleteChirp(tx *sql.Tx, c Chirp) error {
+	var replies int
+
+	err := tx.QueryRow(`SELECT count(*) FROM chirps WHERE in_reply_to = ?`, c.Id).Scan(&replies)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM reports WHERE chirp_id = ? AND action_id IS NULL`, c.Id)
+	if err != nil {
+		return err
+	}
+
+	// the delete cascades to the index and notification rows, replies
+	// are only checked on commit when the tombstone has taken its place
+	_, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, c.Id)
+	if err != nil {
+		return err
+	}
+
+	if replies > 0 {
+		_, err = insertChirp(tx, tombstone(c, timestamp()))
+		return err
+	}
+
+	return pruneTombstones(tx, c.InReplyTo)
+}
+
+func (s *SQLiteDB) CreateUser(email string, password string, handle string) (User, error) {
+	handle, err := checkHandle(handle)
+	if err != nil {
+		return User{}, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	now := timestamp()
+
+	res, err := s.db.Exec(
+		`INSERT INTO users (email, email_key, handle, password_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		email, normalizeEmail(email), nullString(handle), hash, now.UnixNano(), now.UnixNano(),
+	)
+	if err != nil {
+		return User{}, userConflict(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{Id: int(id), Email: email, Handle: handle, IsChirpyRed: false, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+// UpdateUser reads and writes the user in one transaction, so a profile
+// edit and a concurrent upgrade don't undo each other
+func (s *SQLiteDB) UpdateUser(id int, email string, password string, handle string, profile ProfileUpdate, isChirpyRed bool) (User, error) {
+	handle, err := checkHandle(handle)
+	if err != nil {
+		return User{}, err
+	}
+
+	// bcrypt is slow, hash before the transaction holds the connection
+	var hash []byte
+	if password != "" {
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if handle != "" {
+		u.Handle = handle
+	}
+
+	u.Profile = profile.apply(u.Profile)
+
+	err = u.Profile.check()
+	if err != nil {
+		return User{}, err
+	}
+
+	if hash != nil {
+		u.PasswordHash = hash
+	}
+
+	if email != "" {
+		u.Email = email
+	}
+
+	if isChirpyRed {
+		u.IsChirpyRed = true
+	}
+
+	u.UpdatedAt = timestamp()
+
+	_, err = tx.Exec(
+		`UPDATE users SET email = ?, email_key = ?, handle = ?, password_hash = ?, is_chirpy_red = ?, display_name = ?, bio = ?, avatar_url = ?, updated_at = ? WHERE id = ?`,
+		u.Email, normalizeEmail(u.Email), nullString(u.Handle), u.PasswordHash, u.IsChirpyRed, u.DisplayName, u.Bio, u.AvatarURL, u.UpdatedAt.UnixNano(), u.Id,
+	)
+	if err != nil {
+		return User{}, userConflict(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+
+	return u.withoutPassword(), nil
+}
+
+func (s *SQLiteDB) Login(email string, password string) (User, error) {
+	u, err := s.getUser(`WHERE email_key = ?`, normalizeEmail(email))
+	if err != nil {
+		return User{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password))
+	if err != nil {
+		return User{}, ErrUnAuthorized
+	}
+
+	return u.withoutPassword(), nil
+}
+
+func (s *SQLiteDB) GetUser(id int) (User, error) {
+	u, err := s.getUser(`WHERE id = ?`, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	return u.withoutPassword(), nil
+}
+
+// SetAdmin grants or takes away access to the admin endpoints
+func (s *SQLiteDB) SetAdmin(email string, isAdmin bool) (User, error) {
+	u, err := s.getUser(`WHERE email_key = ?`, normalizeEmail(email))
+	if err != nil {
+		return User{}, err
+	}
+
+	u.IsAdmin = isAdmin
+	u.UpdatedAt = timestamp()
+
+	_, err = s.db.Exec(`UPDATE users SET is_admin = ?, updated_at = ? WHERE id = ?`, isAdmin, u.UpdatedAt.UnixNano(), u.Id)
+	if err != nil {
+		return User{}, err
+	}
+
+	return u.withoutPassword(), nil
+}
+
+// RevokeToken stores a refresh token as revoked until it expires,
+// by hash so the database never holds a usable token
+func (s *SQLiteDB) RevokeToken(token string, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO revoked_tokens (token_key, revoked_at, expires_at) VALUES (?, ?, ?)`,
+		tokenKey(token), time.Now(), expiresAt.Unix(),
+	)
+
+	return err
+}
+
+func (s *SQLiteDB) IsRevoked(token string) (bool, error) {
+	var n int
+
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM revoked_tokens WHERE token_key = ?`, tokenKey(token)).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// PurgeRevokedTokens forgets revocations of tokens that expired
+// before now, they are rejected for being expired anyway
+func (s *SQLiteDB) PurgeRevokedTokens(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+func (s *SQLiteDB) CountRevokedTokens() (int, error) {
+	var n int
+
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM revoked_tokens`).Scan(&n)
+
+	return n, err
+}
+
+// getUser returns the full user record, including the password hash,
+// matching the where clause
+func (s *SQLiteDB) getUser(where string, args ...any) (User, error) {
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users `+where, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+// migrateSQLiteRevokedTokens rekeys revocations from the token itself
+// to its hash and gives them an expiry, in unix seconds so purging
+// can compare them
+func migrateSQLiteRevokedTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE revoked_tokens_by_key (
+	token_key  TEXT     PRIMARY KEY,
+	revoked_at DATETIME NOT NULL,
+	expires_at INTEGER  NOT NULL
+);
+
+CREATE INDEX revoked_tokens_expires_at ON revoked_tokens_by_key (expires_at);
+`)
+	if err != nil {
+		return err
+	}
+
+	revoked := map[string]time.Time{}
+	err = scanRows(tx, `SELECT token, revoked_at FROM revoked_tokens`, func(rows *sql.Rows) error {
+		var token string
+		var revokedAt time.Time
+		err := rows.Scan(&token, &revokedAt)
+		if err != nil {
+			return err
+		}
+
+		revoked[token] = revokedAt
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for token, revokedAt := range revoked {
+		_, err = tx.Exec(
+			`INSERT INTO revoked_tokens_by_key (token_key, revoked_at, expires_at) VALUES (?, ?, ?)`,
+			tokenKey(token), revokedAt, revokedAt.Add(maxRefreshTokenAge).Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+DROP TABLE revoked_tokens;
+ALTER TABLE revoked_tokens_by_key RENAME TO revoked_tokens;
+`)
+
+	return err
+}
+
+// migrateSQLiteTimestamps stamps rows from before timestamps with the
+// time of the migration, see migrateTimestamps. Times are stored in
+// unix nanoseconds so they compare and round trip exactly
+func migrateSQLiteTimestamps(tx *sql.Tx) error {
+	now := timestamp().UnixNano()
+
+	for _, table := range []string{"chirps", "users"} {
+		for _, column := range []string{"created_at", "updated_at"} {
+			_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s INTEGER NOT NULL DEFAULT 0`, table, column))
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = ?`, table, column), now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.Exec(`CREATE INDEX chirps_created_at ON chirps (created_at, id)`)
+
+	return err
+}
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const chirpColumns = `id, author_id, body, tags, mentions, in_reply_to, deleted, like_count, rechirp_count, created_at, updated_at, edited_at, flags, hidden`
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	c := Chirp{}
+	var tags, mentions, flags string
+	var inReplyTo, editedAt sql.NullInt64
+	var createdAt, updatedAt int64
+
+	err := row.Scan(&c.Id, &c.AuthorId, &c.Body, &tags, &mentions, &inReplyTo, &c.Deleted, &c.LikeCount, &c.RechirpCount, &createdAt, &updatedAt, &editedAt, &flags, &c.Hidden)
+	c.Tags = strings.Fields(tags)
+	c.Flags = strings.Fields(flags)
+	c.Mentions = splitIds(mentions)
+	c.InReplyTo = int(inReplyTo.Int64)
+	c.CreatedAt = time.Unix(0, createdAt).UTC()
+	c.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	if editedAt.Valid {
+		t := time.Unix(0, editedAt.Int64).UTC()
+		c.EditedAt = &t
+	}
+
+	return c, err
+}
+
+const userColumns = `id, email, handle, password_hash, is_chirpy_red, is_admin, created_at, updated_at, display_name, bio, avatar_url`
+
+func scanUser(row rowScanner) (User, error) {
+	u := User{}
+	var handle sql.NullString
+	var createdAt, updatedAt int64
+
+	err := row.Scan(&u.Id, &u.Email, &handle, &u.PasswordHash, &u.IsChirpyRed, &u.IsAdmin, &createdAt, &updatedAt, &u.DisplayName, &u.Bio, &u.AvatarURL)
+	u.Handle = handle.String
+	u.CreatedAt = time.Unix(0, createdAt).UTC()
+	u.UpdatedAt = time.Unix(0, updatedAt).UTC()
+
+	return u, err
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// userConflict tells which unique column of users a write collided on
+func userConflict(err error) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+
+	if strings.Contains(err.Error(), "users.handle") {
+		return ErrDuplicateHandle
+	}
+
+	return ErrDuplicateEmail
+}
+
+// nullString stores an empty string as NULL, for
+// unique columns that are optional
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullInt stores a zero id as NULL, so sqlite picks a new
+// one or a reference to no row isn't checked
+func nullInt(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// migrateSQLiteEmailKeys recomputes the email keys with normalizeEmail,
+// the sql that first filled them trimmed only spaces and not the other
+// whitespace the json driver trims
+func migrateSQLiteEmailKeys(tx *sql.Tx) error {
+	keys := map[int]string{}
+	seen := map[string]int{}
+
+	err := scanRows(tx, `SELECT id, email FROM users ORDER BY id`, func(rows *sql.Rows) error {
+		var id int
+		var email string
+		err := rows.Scan(&id, &email)
+		if err != nil {
+			return err
+		}
+
+		key := normalizeEmail(email)
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("users %d and %d share the email %q, change one of them and run migrate again", other, id, key)
+		}
+		seen[key] = id
+		keys[id] = key
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// cleared first so swapping two keys doesn't trip the unique index
+	_, err = tx.Exec(`UPDATE users SET email_key = NULL`)
+	if err != nil {
+		return err
+	}
+
+	for id, key := range keys {
+		_, err = tx.Exec(`UPDATE users SET email_key = ? WHERE id = ?`, key, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
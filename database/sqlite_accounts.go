@@ -0,0 +1,90 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// DeleteUser deletes a user and everything they left behind in one transaction
+func (s *SQLiteDB) DeleteUser(id int) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	// reactions first, they move the counters of chirps that may go below
+	for kind, counter := range reactionCounters {
+		_, err = tx.Exec(
+			`UPDATE chirps SET `+counter+` = `+counter+` - 1
+WHERE id IN (SELECT chirp_id FROM reactions WHERE kind = ? AND user_id = ?)`,
+			kind, id,
+		)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM reactions WHERE user_id = ?`, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM follows WHERE follower_id = ? OR followee_id = ?`, id, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	// newest first, so their replies to themselves go before
+	// what they reply to and don't leave tombstones behind
+	chirps := []Chirp{}
+	err = scanRows(tx, `SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? AND deleted = 0 ORDER BY id DESC`, func(rows *sql.Rows) error {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return err
+		}
+
+		chirps = append(chirps, c)
+
+		return nil
+	}, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	for _, c := range chirps {
+		err = deleteChirp(tx, c)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	for _, query := range []string{
+		`DELETE FROM notifications WHERE user_id = ?`,
+		`DELETE FROM logins WHERE user_id = ?`,
+		`DELETE FROM reports WHERE reporter_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	} {
+		_, err = tx.Exec(query, id)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	return u.withoutPassword(), tx.Commit()
+}
+
+// migrateSQLiteUserCleanup indexes what a user leaves behind
+// that has to go when they delete their account
+var migrateSQLiteUserCleanup = execSQL(`
+CREATE INDEX reactions_user_id ON reactions (user_id);
+CREATE INDEX reports_reporter_id ON reports (reporter_id);
+`)
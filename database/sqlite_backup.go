@@ -0,0 +1,364 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Backup writes a point in time copy of the database to w in the same
+// format as the json database, read inside a single transaction
+func (s *SQLiteDB) Backup(w io.Writer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ds := newDbStructure()
+
+	err = scanRows(tx, `SELECT `+userColumns+` FROM users`, func(rows *sql.Rows) error {
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.Users[u.Id] = u
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+chirpColumns+` FROM chirps`, func(rows *sql.Rows) error {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.Chirps[c.Id] = c
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT token_key, revoked_at, expires_at FROM revoked_tokens`, func(rows *sql.Rows) error {
+		var key string
+		var expiresAt int64
+		t := RevokedToken{}
+		err := rows.Scan(&key, &t.RevokedAt, &expiresAt)
+		if err != nil {
+			return err
+		}
+
+		t.ExpiresAt = time.Unix(expiresAt, 0)
+		ds.RevokedTokens[key] = t
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+notificationColumns+` FROM notifications`, func(rows *sql.Rows) error {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.Notifications[n.Id] = n
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+reactionColumns+` FROM reactions`, func(rows *sql.Rows) error {
+		r, err := scanReaction(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.putReaction(r)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+revisionColumns+` FROM chirp_revisions ORDER BY created_at, rowid`, func(rows *sql.Rows) error {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.Revisions[rev.ChirpId] = append(ds.Revisions[rev.ChirpId], rev)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+followColumns+` FROM follows`, func(rows *sql.Rows) error {
+		f, err := scanFollow(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.putFollow(f)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+loginColumns+` FROM logins ORDER BY created_at, rowid`, func(rows *sql.Rows) error {
+		l, err := scanLogin(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.Logins[l.UserId] = append(ds.Logins[l.UserId], l)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+reportColumns+` FROM reports`, func(rows *sql.Rows) error {
+		r, err := scanReport(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.Reports[r.Id] = r
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = scanRows(tx, `SELECT `+moderationActionColumns+` FROM moderation_actions`, func(rows *sql.Rows) error {
+		a, err := scanModerationAction(rows)
+		if err != nil {
+			return err
+		}
+
+		ds.ModerationActions[a.Id] = a
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	*ds.Sequences, err = readSequences(tx)
+	if err != nil {
+		return err
+	}
+
+	// the connection is free again before a slow client reads the backup
+	tx.Rollback()
+
+	buf, err := json.MarshalIndent(ds, "", " ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+
+	return err
+}
+
+// Restore replaces every row with a validated backup from r
+// inside a single transaction
+func (s *SQLiteDB) Restore(r io.Reader) error {
+	ds, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// ids handed out after the backup was taken stay used
+	current, err := readSequences(tx)
+	if err != nil {
+		return err
+	}
+
+	ds.keepSequences(&current)
+
+	for _, table := range []string{"notifications", "chirps", "users", "revoked_tokens", "reports", "moderation_actions", "follows", "logins"} {
+		_, err = tx.Exec(`DELETE FROM ` + table)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, u := range ds.Users {
+		_, err = tx.Exec(
+			`INSERT INTO users (`+userColumns+`, email_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			u.Id, u.Email, nullString(u.Handle), u.PasswordHash, u.IsChirpyRed, u.IsAdmin, u.CreatedAt.UnixNano(), u.UpdatedAt.UnixNano(),
+			u.DisplayName, u.Bio, u.AvatarURL, normalizeEmail(u.Email),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range ds.Chirps {
+		_, err = insertChirp(tx, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, n := range ds.Notifications {
+		err = insertNotification(tx, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, revisions := range ds.Revisions {
+		for _, rev := range revisions {
+			err = insertRevision(tx, rev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, kind := range []string{ReactionLike, ReactionRechirp} {
+		for chirpId, users := range ds.reactions(kind) {
+			for userId, at := range users {
+				err = insertReaction(tx, Reaction{Kind: kind, ChirpId: chirpId, UserId: userId, CreatedAt: at})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for followerId, followees := range ds.Follows {
+		for followeeId, at := range followees {
+			err = insertFollow(tx, Follow{FollowerId: followerId, FolloweeId: followeeId, CreatedAt: at})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, logins := range ds.Logins {
+		for _, l := range logins {
+			err = insertLogin(tx, l)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, a := range ds.ModerationActions {
+		_, err = insertModerationAction(tx, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range ds.Reports {
+		err = insertReport(tx, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, t := range ds.RevokedTokens {
+		_, err = tx.Exec(
+			`INSERT INTO revoked_tokens (token_key, revoked_at, expires_at) VALUES (?, ?, ?)`,
+			key, t.RevokedAt, t.ExpiresAt.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the inserts above moved the sequences to the highest restored id,
+	// put them back so ids deleted before the backup aren't reused
+	_, err = tx.Exec(`DELETE FROM sqlite_sequence`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO sqlite_sequence (name, seq) VALUES ('chirps', ?), ('users', ?), ('notifications', ?), ('reports', ?), ('moderation_actions', ?)`,
+		ds.Sequences.Chirps, ds.Sequences.Users, ds.Sequences.Notifications, ds.Sequences.Reports, ds.Sequences.ModerationActions,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// readSequences returns the last AUTOINCREMENT id of every table
+func readSequences(tx *sql.Tx) (Sequences, error) {
+	seq := Sequences{}
+
+	err := scanRows(tx, `SELECT name, seq FROM sqlite_sequence`, func(rows *sql.Rows) error {
+		var name string
+		var n int
+		err := rows.Scan(&name, &n)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case "chirps":
+			seq.Chirps = n
+		case "users":
+			seq.Users = n
+		case "notifications":
+			seq.Notifications = n
+		case "reports":
+			seq.Reports = n
+		case "moderation_actions":
+			seq.ModerationActions = n
+		}
+
+		return nil
+	})
+
+	return seq, err
+}
+
+// scanRows calls fn for every row the query returns
+func scanRows(tx *sql.Tx, query string, fn func(*sql.Rows) error, args ...any) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = fn(rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EditChirp replaces the body of a chirp and keeps the one it had as a
+// revision, only its author can and only within window after posting.
+// Users it newly mentions are notified, users it no longer mentions
+// lose the notification
+func (s *SQLiteDB) EditChirp(id int, authorId int, body string, flags []string, window time.Duration) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	err = checkActor(tx, authorId)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	old, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	now := timestamp()
+
+	err = old.checkEdit(authorId, window, now)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	c, rev := old.edit(body, flags, now)
+
+	c.Mentions, err = resolveHandles(tx, extractMentions(body))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = insertRevision(tx, rev)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE chirps SET body = ?, tags = ?, mentions = ?, flags = ?, edited_at = ?, updated_at = ? WHERE id = ?`,
+		c.Body, joinTags(c.Tags), joinIds(c.Mentions), joinTags(c.Flags), c.EditedAt.UnixNano(), c.UpdatedAt.UnixNano(), c.Id,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	// the index rows of the old body go, the new body's take their place
+	err = unindexChirp(tx, c.Id)
+	if err == nil {
+		err = insertChirpTerms(tx, c)
+	}
+	if err == nil {
+		err = insertChirpTags(tx, c)
+	}
+	if err == nil {
+		err = insertChirpMentions(tx, c)
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	for _, userId := range unmentioned(old.Mentions, c.Mentions) {
+		_, err = tx.Exec(`DELETE FROM notifications WHERE chirp_id = ? AND user_id = ?`, c.Id, userId)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	for _, n := range mentionNotifications(c, old.Mentions) {
+		err = insertNotification(tx, n)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	return c, tx.Commit()
+}
+
+// GetRevisions returns the bodies a chirp had before, oldest first
+func (s *SQLiteDB) GetRevisions(id int) ([]Revision, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var gone bool
+
+	err = tx.QueryRow(`SELECT deleted OR hidden FROM chirps WHERE id = ?`, id).Scan(&gone)
+	if errors.Is(err, sql.ErrNoRows) || gone {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []Revision{}
+
+	err = scanRows(tx, `SELECT `+revisionColumns+` FROM chirp_revisions WHERE chirp_id = ? ORDER BY created_at, rowid`, func(rows *sql.Rows) error {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return err
+		}
+
+		revisions = append(revisions, rev)
+
+		return nil
+	}, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+const revisionColumns = `chirp_id, body, created_at, replaced_at`
+
+func scanRevision(row rowScanner) (Revision, error) {
+	rev := Revision{}
+	var createdAt, replacedAt int64
+
+	err := row.Scan(&rev.ChirpId, &rev.Body, &createdAt, &replacedAt)
+	rev.CreatedAt = time.Unix(0, createdAt).UTC()
+	rev.ReplacedAt = time.Unix(0, replacedAt).UTC()
+
+	return rev, err
+}
+
+func insertRevision(tx *sql.Tx, rev Revision) error {
+	_, err := tx.Exec(
+		`INSERT INTO chirp_revisions (`+revisionColumns+`) VALUES (?, ?, ?, ?)`,
+		rev.ChirpId, rev.Body, rev.CreatedAt.UnixNano(), rev.ReplacedAt.UnixNano(),
+	)
+
+	return err
+}
+
+// migrateSQLiteEdits adds the time chirps were edited
+// and the bodies they had before
+var migrateSQLiteEdits = execSQL(`
+ALTER TABLE chirps ADD COLUMN edited_at INTEGER;
+
+CREATE TABLE chirp_revisions (
+	chirp_id    INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	body        TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL,
+	replaced_at INTEGER NOT NULL
+);
+
+CREATE INDEX chirp_revisions_chirp_id ON chirp_revisions (chirp_id, created_at);
+`)
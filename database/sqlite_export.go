@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ExportUser collects what the database holds about a user,
+// read inside a single transaction
+func (s *SQLiteDB) ExportUser(id int) (Export, error) {
+	e := Export{Chirps: []Chirp{}, Logins: []Login{}}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Export{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Export{}, ErrNotFound
+	}
+	if err != nil {
+		return Export{}, err
+	}
+
+	e.Account = u.Account()
+
+	err = scanRows(tx, `SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? AND deleted = 0 ORDER BY id`, func(rows *sql.Rows) error {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return err
+		}
+
+		e.Chirps = append(e.Chirps, c.Public())
+
+		return nil
+	}, id)
+	if err != nil {
+		return Export{}, err
+	}
+
+	err = scanRows(tx, `SELECT `+loginColumns+` FROM logins WHERE user_id = ? ORDER BY created_at DESC, rowid DESC`, func(rows *sql.Rows) error {
+		l, err := scanLogin(rows)
+		if err != nil {
+			return err
+		}
+
+		e.Logins = append(e.Logins, l)
+
+		return nil
+	}, id)
+	if err != nil {
+		return Export{}, err
+	}
+
+	e.ExportedAt = timestamp()
+
+	return e, nil
+}
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Follow makes a user follow another, following twice changes nothing
+func (s *SQLiteDB) Follow(followerId int, followeeId int) (Follow, error) {
+	if followerId == followeeId {
+		return Follow{}, ErrFollowSelf
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Follow{}, err
+	}
+	defer tx.Rollback()
+
+	err = checkActor(tx, followerId)
+	if err != nil {
+		return Follow{}, err
+	}
+
+	err = checkUser(tx, followeeId)
+	if err != nil {
+		return Follow{}, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT OR IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`,
+		followerId, followeeId, timestamp().UnixNano(),
+	)
+	if err != nil {
+		return Follow{}, err
+	}
+
+	f, err := scanFollow(tx.QueryRow(
+		`SELECT `+followColumns+` FROM follows WHERE follower_id = ? AND followee_id = ?`,
+		followerId, followeeId,
+	))
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return f, tx.Commit()
+}
+
+// Unfollow stops a user following another, if they do
+func (s *SQLiteDB) Unfollow(followerId int, followeeId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkUser(tx, followeeId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerId, followeeId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetFollows returns a page of the followers of a user or of the users they follow
+func (s *SQLiteDB) GetFollows(q FollowQuery) ([]Follow, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = checkUser(tx, q.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	user, other := "followee_id", "follower_id"
+	if q.Following {
+		user, other = other, user
+	}
+
+	query := `SELECT ` + followColumns + ` FROM follows WHERE ` + user + ` = ?`
+	args := []any{q.UserId}
+
+	if q.After.Id != 0 {
+		query += ` AND (created_at, ` + other + `) < (?, ?)`
+		args = append(args, q.After.CreatedAt.UnixNano(), q.After.Id)
+	}
+
+	query += ` ORDER BY created_at DESC, ` + other + ` DESC`
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	follows := []Follow{}
+
+	err = scanRows(tx, query, func(rows *sql.Rows) error {
+		f, err := scanFollow(rows)
+		if err != nil {
+			return err
+		}
+
+		follows = append(follows, f)
+
+		return nil
+	}, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return follows, nil
+}
+
+// GetTimeline returns a page of the home timeline of a user
+func (s *SQLiteDB) GetTimeline(q TimelineQuery) ([]Chirp, error) {
+	query := `
+SELECT ` + chirpColumns + ` FROM chirps
+WHERE deleted = 0 AND hidden = 0
+AND (author_id = ? OR author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?))`
+	args := []any{q.UserId, q.UserId}
+
+	if q.After.Id != 0 {
+		query += ` AND (created_at, id) < (?, ?)`
+		args = append(args, q.After.CreatedAt.UnixNano(), q.After.Id)
+	}
+
+	query += ` ORDER BY created_at DESC, id DESC`
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		chirps = append(chirps, c)
+	}
+
+	return chirps, rows.Err()
+}
+
+// checkUser makes sure there is a user with the id
+func checkUser(tx *sql.Tx, id int) error {
+	err := tx.QueryRow(`SELECT id FROM users WHERE id = ?`, id).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// checkActor makes sure the user acting exists, see DbStructure.checkActor
+func checkActor(tx *sql.Tx, id int) error {
+	err := checkUser(tx, id)
+	if errors.Is(err, ErrNotFound) {
+		return ErrUserNotFound
+	}
+
+	return err
+}
+
+const followColumns = `follower_id, followee_id, created_at`
+
+func scanFollow(row rowScanner) (Follow, error) {
+	f := Follow{}
+	var createdAt int64
+
+	err := row.Scan(&f.FollowerId, &f.FolloweeId, &createdAt)
+	f.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return f, err
+}
+
+func insertFollow(tx *sql.Tx, f Follow) error {
+	_, err := tx.Exec(
+		`INSERT INTO follows (`+followColumns+`) VALUES (?, ?, ?)`,
+		f.FollowerId, f.FolloweeId, f.CreatedAt.UnixNano(),
+	)
+
+	return err
+}
+
+// migrateSQLiteFollows adds who follows whom, and an index to read
+// the newest chirps of each author the timeline merges
+var migrateSQLiteFollows = execSQL(`
+CREATE TABLE follows (
+	follower_id INTEGER NOT NULL,
+	followee_id INTEGER NOT NULL,
+	created_at  INTEGER NOT NULL,
+	PRIMARY KEY (follower_id, followee_id)
+) WITHOUT ROWID;
+
+CREATE INDEX follows_follower_created_at ON follows (follower_id, created_at, followee_id);
+CREATE INDEX follows_followee_created_at ON follows (followee_id, created_at, follower_id);
+
+CREATE INDEX chirps_author_created_at ON chirps (author_id, created_at, id);
+`)
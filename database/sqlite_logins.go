@@ -0,0 +1,71 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RecordLogin adds a login to the history of its user
+func (s *SQLiteDB) RecordLogin(l Login) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkUser(tx, l.UserId)
+	if err != nil {
+		return err
+	}
+
+	l.UserAgent = truncateUserAgent(l.UserAgent)
+	l.CreatedAt = timestamp()
+
+	err = insertLogin(tx, l)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+DELETE FROM logins WHERE user_id = ? AND rowid NOT IN (
+	SELECT rowid FROM logins WHERE user_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ?
+)`, l.UserId, l.UserId, maxLogins)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const loginColumns = `user_id, ip, user_agent, created_at`
+
+func scanLogin(row rowScanner) (Login, error) {
+	l := Login{}
+	var createdAt int64
+
+	err := row.Scan(&l.UserId, &l.IP, &l.UserAgent, &createdAt)
+	l.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return l, err
+}
+
+func insertLogin(tx *sql.Tx, l Login) error {
+	_, err := tx.Exec(
+		`INSERT INTO logins (`+loginColumns+`) VALUES (?, ?, ?, ?)`,
+		l.UserId, l.IP, l.UserAgent, l.CreatedAt.UnixNano(),
+	)
+
+	return err
+}
+
+// migrateSQLiteLogins adds the login history of users
+var migrateSQLiteLogins = execSQL(`
+CREATE TABLE logins (
+	user_id    INTEGER NOT NULL,
+	ip         TEXT    NOT NULL DEFAULT '',
+	user_agent TEXT    NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX logins_user_created_at ON logins (user_id, created_at);
+`)
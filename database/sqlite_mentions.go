@@ -0,0 +1,198 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetNotifications returns a page of a user's notifications, newest first
+func (s *SQLiteDB) GetNotifications(q NotificationQuery) ([]Notification, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notifications WHERE user_id = ?`
+	args := []any{q.UserId}
+
+	if q.After != 0 {
+		query += ` AND id < ?`
+		args = append(args, q.After)
+	}
+	if q.UnreadOnly {
+		query += ` AND read_at IS NULL`
+	}
+
+	query += ` ORDER BY id DESC`
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+// MarkNotificationsRead marks notifications of a user as read, all of
+// the unread ones if ids is empty. It returns how many it marked
+func (s *SQLiteDB) MarkNotificationsRead(userId int, ids []int) (int, error) {
+	query := `UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL`
+	args := []any{timestamp().UnixNano(), userId}
+
+	if len(ids) > 0 {
+		query += ` AND id IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + `)`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// resolveHandles returns the ids of the users with the given handles,
+// handles nobody has are skipped
+func resolveHandles(tx *sql.Tx, handles []string) ([]int, error) {
+	var ids []int
+
+	for _, handle := range handles {
+		var id int
+
+		err := tx.QueryRow(`SELECT id FROM users WHERE handle = ?`, handle).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// insertChirpMentions adds a chirp to the chirps mentioning each of its users
+func insertChirpMentions(tx *sql.Tx, c Chirp) error {
+	for _, userId := range c.Mentions {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO chirp_mentions (user_id, chirp_id) VALUES (?, ?)`, userId, c.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertNotification stores n, with a new id unless it has one
+func insertNotification(tx *sql.Tx, n Notification) error {
+	var readAt, chirpId any
+	if n.ReadAt != nil {
+		readAt = n.ReadAt.UnixNano()
+	}
+	if n.ChirpId != 0 {
+		chirpId = n.ChirpId
+	}
+
+	var id any
+	if n.Id != 0 {
+		id = n.Id
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO notifications (`+notificationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, n.UserId, n.Type, n.ActorId, chirpId, n.CreatedAt.UnixNano(), readAt,
+	)
+
+	return err
+}
+
+const notificationColumns = `id, user_id, type, actor_id, chirp_id, created_at, read_at`
+
+func scanNotification(row rowScanner) (Notification, error) {
+	n := Notification{}
+	var chirpId, readAt sql.NullInt64
+	var createdAt int64
+
+	err := row.Scan(&n.Id, &n.UserId, &n.Type, &n.ActorId, &chirpId, &createdAt, &readAt)
+	n.ChirpId = int(chirpId.Int64)
+	n.CreatedAt = time.Unix(0, createdAt).UTC()
+	if readAt.Valid {
+		t := time.Unix(0, readAt.Int64).UTC()
+		n.ReadAt = &t
+	}
+
+	return n, err
+}
+
+// joinIds is how the mentions of a chirp are kept on its row
+func joinIds(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func splitIds(s string) []int {
+	var ids []int
+
+	for _, part := range strings.Fields(s) {
+		id, err := strconv.Atoi(part)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// migrateSQLiteMentions adds handles to users, the users a chirp
+// mentions and an inbox of notifications
+var migrateSQLiteMentions = execSQL(`
+ALTER TABLE users ADD COLUMN handle TEXT;
+CREATE UNIQUE INDEX users_handle ON users (handle);
+
+ALTER TABLE chirps ADD COLUMN mentions TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE chirp_mentions (
+	user_id  INTEGER NOT NULL,
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, chirp_id)
+) WITHOUT ROWID;
+
+CREATE INDEX chirp_mentions_chirp_id ON chirp_mentions (chirp_id);
+
+CREATE TABLE notifications (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id    INTEGER NOT NULL,
+	type       TEXT    NOT NULL,
+	actor_id   INTEGER NOT NULL,
+	chirp_id   INTEGER REFERENCES chirps (id) ON DELETE CASCADE,
+	created_at INTEGER NOT NULL,
+	read_at    INTEGER
+);
+
+CREATE INDEX notifications_user_id ON notifications (user_id, id);
+CREATE INDEX notifications_chirp_id ON notifications (chirp_id);
+`)
@@ -0,0 +1,292 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReportChirp files a report on a chirp, a user with an open
+// report on it already gets that one back
+func (s *SQLiteDB) ReportChirp(chirpId int, reporterId int, reason string) (Report, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	err = checkActor(tx, reporterId)
+	if err != nil {
+		return Report{}, err
+	}
+
+	var gone bool
+
+	err = tx.QueryRow(`SELECT deleted OR hidden FROM chirps WHERE id = ?`, chirpId).Scan(&gone)
+	if errors.Is(err, sql.ErrNoRows) || gone {
+		return Report{}, ErrNotFound
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	// the unique index on open reports turns a second one into a no-op
+	_, err = tx.Exec(
+		`INSERT OR IGNORE INTO reports (chirp_id, reporter_id, reason, created_at) VALUES (?, ?, ?, ?)`,
+		chirpId, reporterId, reason, timestamp().UnixNano(),
+	)
+	if err != nil {
+		return Report{}, err
+	}
+
+	r, err := scanReport(tx.QueryRow(
+		`SELECT `+reportColumns+` FROM reports WHERE chirp_id = ? AND reporter_id = ? AND action_id IS NULL`,
+		chirpId, reporterId,
+	))
+	if err != nil {
+		return Report{}, err
+	}
+
+	return r, tx.Commit()
+}
+
+// GetModerationQueue returns a page of the chirps waiting for an admin
+func (s *SQLiteDB) GetModerationQueue(q QueueQuery) ([]QueueItem, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+SELECT ` + chirpColumns + ` FROM chirps
+WHERE deleted = 0 AND hidden = 0 AND id > ?
+AND (flags != '' OR id IN (SELECT chirp_id FROM reports WHERE action_id IS NULL))
+ORDER BY id`
+	args := []any{q.After}
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	items := []QueueItem{}
+	positions := map[int]int{}
+
+	err = scanRows(tx, query, func(rows *sql.Rows) error {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return err
+		}
+
+		positions[c.Id] = len(items)
+		items = append(items, QueueItem{Chirp: c, Reports: []Report{}})
+
+		return nil
+	}, args...)
+	if err != nil || len(items) == 0 {
+		return items, err
+	}
+
+	ids := make([]any, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.Chirp.Id)
+	}
+
+	err = scanRows(tx, `
+SELECT `+reportColumns+` FROM reports
+WHERE action_id IS NULL AND chirp_id IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")+`)
+ORDER BY id`, func(rows *sql.Rows) error {
+		r, err := scanReport(rows)
+		if err != nil {
+			return err
+		}
+
+		item := &items[positions[r.ChirpId]]
+		item.Reports = append(item.Reports, r)
+
+		return nil
+	}, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Moderate hides, deletes or dismisses a chirp for an admin and
+// closes the open reports on it
+func (s *SQLiteDB) Moderate(chirpId int, adminId int, action string) (ModerationAction, error) {
+	if !validModeration(action) {
+		return ModerationAction{}, fmt.Errorf("unknown moderation action %q", action)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	defer tx.Rollback()
+
+	c, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0`, chirpId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ModerationAction{}, ErrNotFound
+	}
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	a := ModerationAction{
+		ChirpId:   chirpId,
+		AdminId:   adminId,
+		Action:    action,
+		Flags:     c.Flags,
+		CreatedAt: timestamp(),
+	}
+
+	a.Id, err = insertModerationAction(tx, a)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	// before a delete, which drops the open reports
+	_, err = tx.Exec(`UPDATE reports SET action_id = ? WHERE chirp_id = ? AND action_id IS NULL`, a.Id, chirpId)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	switch action {
+	case ModerationHide:
+		_, err = tx.Exec(`UPDATE chirps SET hidden = 1, updated_at = ? WHERE id = ?`, a.CreatedAt.UnixNano(), chirpId)
+		if err == nil {
+			err = unindexChirp(tx, chirpId)
+		}
+	case ModerationDelete:
+		err = deleteChirp(tx, c)
+	case ModerationDismiss:
+		_, err = tx.Exec(`UPDATE chirps SET flags = '', updated_at = ? WHERE id = ?`, a.CreatedAt.UnixNano(), chirpId)
+	}
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	return a, tx.Commit()
+}
+
+// GetModerationActions returns a page of what admins did, newest first
+func (s *SQLiteDB) GetModerationActions(q ModerationActionQuery) ([]ModerationAction, error) {
+	query := `SELECT ` + moderationActionColumns + ` FROM moderation_actions`
+	args := []any{}
+
+	if q.After != 0 {
+		query += ` WHERE id < ?`
+		args = append(args, q.After)
+	}
+
+	query += ` ORDER BY id DESC`
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []ModerationAction{}
+	for rows.Next() {
+		a, err := scanModerationAction(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		actions = append(actions, a)
+	}
+
+	return actions, rows.Err()
+}
+
+const reportColumns = `id, chirp_id, reporter_id, reason, created_at, action_id`
+
+func scanReport(row rowScanner) (Report, error) {
+	r := Report{}
+	var actionId sql.NullInt64
+	var createdAt int64
+
+	err := row.Scan(&r.Id, &r.ChirpId, &r.ReporterId, &r.Reason, &createdAt, &actionId)
+	r.CreatedAt = time.Unix(0, createdAt).UTC()
+	r.ActionId = int(actionId.Int64)
+
+	return r, err
+}
+
+func insertReport(tx *sql.Tx, r Report) error {
+	_, err := tx.Exec(
+		`INSERT INTO reports (`+reportColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		r.Id, r.ChirpId, r.ReporterId, r.Reason, r.CreatedAt.UnixNano(), nullInt(r.ActionId),
+	)
+
+	return err
+}
+
+const moderationActionColumns = `id, chirp_id, admin_id, action, flags, created_at`
+
+func scanModerationAction(row rowScanner) (ModerationAction, error) {
+	a := ModerationAction{}
+	var flags string
+	var createdAt int64
+
+	err := row.Scan(&a.Id, &a.ChirpId, &a.AdminId, &a.Action, &flags, &createdAt)
+	a.Flags = strings.Fields(flags)
+	a.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return a, err
+}
+
+// insertModerationAction stores a, with a new id unless it has one
+func insertModerationAction(tx *sql.Tx, a ModerationAction) (int, error) {
+	res, err := tx.Exec(
+		`INSERT INTO moderation_actions (`+moderationActionColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		nullInt(a.Id), a.ChirpId, a.AdminId, a.Action, joinTags(a.Flags), a.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+
+	return int(id), err
+}
+
+// migrateSQLiteModeration lets admins hide chirps and adds the reports
+// and actions of the moderation queue. Both outlive the chirp they are
+// about, so they don't reference it
+var migrateSQLiteModeration = execSQL(`
+ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX chirps_flagged ON chirps (id) WHERE flags != '';
+
+CREATE TABLE moderation_actions (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	chirp_id   INTEGER NOT NULL,
+	admin_id   INTEGER NOT NULL,
+	action     TEXT    NOT NULL,
+	flags      TEXT    NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE reports (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	chirp_id    INTEGER NOT NULL,
+	reporter_id INTEGER NOT NULL,
+	reason      TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL,
+	action_id   INTEGER REFERENCES moderation_actions (id) DEFERRABLE INITIALLY DEFERRED
+);
+
+CREATE UNIQUE INDEX reports_open ON reports (chirp_id, reporter_id) WHERE action_id IS NULL;
+`)
@@ -0,0 +1,24 @@
+package database
+
+// GetProfile returns the public profile of a user
+func (s *SQLiteDB) GetProfile(id int) (UserProfile, error) {
+	u, err := s.getUser(`WHERE id = ?`, id)
+	if err != nil {
+		return UserProfile{}, err
+	}
+
+	p := profileOf(u)
+
+	err = s.db.QueryRow(`
+SELECT
+	(SELECT count(*) FROM chirps WHERE author_id = ? AND deleted = 0 AND hidden = 0),
+	(SELECT count(*) FROM follows WHERE followee_id = ?),
+	(SELECT count(*) FROM follows WHERE follower_id = ?)`,
+		id, id, id,
+	).Scan(&p.ChirpCount, &p.FollowerCount, &p.FollowingCount)
+	if err != nil {
+		return UserProfile{}, err
+	}
+
+	return p, nil
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// reactionCounters are the chirps columns counting each kind of reaction
+var reactionCounters = map[string]string{
+	ReactionLike:    "like_count",
+	ReactionRechirp: "rechirp_count",
+}
+
+// AddReaction makes a user react to a chirp, reacting twice
+// changes nothing. It returns the chirp with its new counters
+func (s *SQLiteDB) AddReaction(kind string, chirpId int, userId int) (Chirp, error) {
+	return s.react(kind, chirpId, userId, 1, `
+INSERT OR IGNORE INTO reactions (kind, chirp_id, user_id, created_at) VALUES (?, ?, ?, ?)`,
+		kind, chirpId, userId, timestamp().UnixNano(),
+	)
+}
+
+// RemoveReaction takes back a user's reaction to a chirp, if there is one
+func (s *SQLiteDB) RemoveReaction(kind string, chirpId int, userId int) (Chirp, error) {
+	return s.react(kind, chirpId, userId, -1, `
+DELETE FROM reactions WHERE kind = ? AND chirp_id = ? AND user_id = ?`,
+		kind, chirpId, userId,
+	)
+}
+
+// react runs the statement adding or removing a reaction and moves
+// the counter by n when it did, the primary key on reactions keeps
+// a second reaction from being counted
+func (s *SQLiteDB) react(kind string, chirpId int, userId int, n int, query string, args ...any) (Chirp, error) {
+	counter, ok := reactionCounters[kind]
+	if !ok {
+		return Chirp{}, fmt.Errorf("unknown reaction %q", kind)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	err = checkActor(tx, userId)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	c, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0`, chirpId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	changed, err := res.RowsAffected()
+	if err != nil || changed == 0 {
+		return c, err
+	}
+
+	_, err = tx.Exec(`UPDATE chirps SET `+counter+` = `+counter+` + ? WHERE id = ?`, n, chirpId)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	c.countReaction(kind, n)
+
+	return c, tx.Commit()
+}
+
+// GetReactions returns a page of the reactions of one kind to a chirp
+func (s *SQLiteDB) GetReactions(q ReactionQuery) ([]Reaction, error) {
+	_, err := s.GetChirp(q.ChirpId)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + reactionColumns + ` FROM reactions WHERE kind = ? AND chirp_id = ?`
+	args := []any{q.Kind, q.ChirpId}
+
+	if q.After.Id != 0 {
+		query += ` AND (created_at, user_id) < (?, ?)`
+		args = append(args, q.After.CreatedAt.UnixNano(), q.After.Id)
+	}
+
+	query += ` ORDER BY created_at DESC, user_id DESC`
+
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []Reaction{}
+	for rows.Next() {
+		r, err := scanReaction(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		reactions = append(reactions, r)
+	}
+
+	return reactions, rows.Err()
+}
+
+const reactionColumns = `kind, chirp_id, user_id, created_at`
+
+func scanReaction(row rowScanner) (Reaction, error) {
+	r := Reaction{}
+	var createdAt int64
+
+	err := row.Scan(&r.Kind, &r.ChirpId, &r.UserId, &createdAt)
+	r.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	return r, err
+}
+
+func insertReaction(tx *sql.Tx, r Reaction) error {
+	_, err := tx.Exec(
+		`INSERT INTO reactions (`+reactionColumns+`) VALUES (?, ?, ?, ?)`,
+		r.Kind, r.ChirpId, r.UserId, r.CreatedAt.UnixNano(),
+	)
+
+	return err
+}
+
+// migrateSQLiteReactions adds likes and rechirps, counted on the
+// chirps so listing chirps doesn't have to count them
+var migrateSQLiteReactions = execSQL(`
+ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE reactions (
+	kind       TEXT    NOT NULL,
+	chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	user_id    INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (kind, chirp_id, user_id)
+) WITHOUT ROWID;
+
+CREATE INDEX reactions_created_at ON reactions (kind, chirp_id, created_at, user_id);
+`)
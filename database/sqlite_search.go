@@ -0,0 +1,119 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// SearchChirps returns the chirps matching q, best match first.
+// Only the postings of the query terms are read, ranking is
+// shared with the json database
+func (s *SQLiteDB) SearchChirps(q SearchQuery) ([]Chirp, error) {
+	terms, phrases := parseSearch(q.Text)
+	if len(terms) == 0 {
+		return []Chirp{}, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var total int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM chirps`).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string]postings{}
+	for _, term := range terms {
+		index[term] = postings{}
+
+		err = scanRows(tx, `SELECT chirp_id, position FROM chirp_terms WHERE term = ? ORDER BY chirp_id, position`, func(rows *sql.Rows) error {
+			var id, pos int
+			err := rows.Scan(&id, &pos)
+			if err != nil {
+				return err
+			}
+
+			index[term][id] = append(index[term][id], pos)
+
+			return nil
+		}, term)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	chirps := []Chirp{}
+	for _, id := range rankSearch(terms, phrases, index, total) {
+		c, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+		if err != nil {
+			return nil, err
+		}
+
+		if q.AuthorId != 0 && c.AuthorId != q.AuthorId {
+			continue
+		}
+
+		chirps = append(chirps, c)
+		if len(chirps) == q.Limit {
+			break
+		}
+	}
+
+	return chirps, tx.Commit()
+}
+
+// insertChirpTerms adds a chirp to the search index
+func insertChirpTerms(tx *sql.Tx, c Chirp) error {
+	for term, positions := range chirpTerms(c) {
+		for _, pos := range positions {
+			_, err := tx.Exec(`INSERT INTO chirp_terms (term, chirp_id, position) VALUES (?, ?, ?)`, term, c.Id, pos)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateSQLiteSearch creates the search index, rows go
+// away with their chirp, and fills it with the chirps so far
+func migrateSQLiteSearch(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE chirp_terms (
+	term     TEXT    NOT NULL,
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (term, chirp_id, position)
+) WITHOUT ROWID;
+
+CREATE INDEX chirp_terms_chirp_id ON chirp_terms (chirp_id);
+`)
+	if err != nil {
+		return err
+	}
+
+	chirps := []Chirp{}
+	err = scanRows(tx, `SELECT id, body FROM chirps`, func(rows *sql.Rows) error {
+		c := Chirp{}
+		err := rows.Scan(&c.Id, &c.Body)
+		chirps = append(chirps, c)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chirps {
+		err = insertChirpTerms(tx, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// TrendingTags returns the tags used by the most chirps created since
+func (s *SQLiteDB) TrendingTags(since time.Time, limit int) ([]TagCount, error) {
+	rows, err := s.db.Query(`
+SELECT t.tag, COUNT(*) FROM chirps c
+JOIN chirp_tags t ON t.chirp_id = c.id
+WHERE c.created_at >= ?
+GROUP BY t.tag`, since.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TagCount{}
+	for rows.Next() {
+		tc := TagCount{}
+		err = rows.Scan(&tc.Tag, &tc.Chirps)
+		if err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, tc)
+	}
+
+	return topTags(counts, limit), rows.Err()
+}
+
+// joinTags is how the tags of a chirp are kept on its row,
+// tags have no spaces in them
+func joinTags(tags []string) string {
+	return strings.Join(tags, " ")
+}
+
+// insertChirpTags adds a chirp to the chirps of each of its tags
+func insertChirpTags(tx *sql.Tx, c Chirp) error {
+	for _, tag := range c.Tags {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO chirp_tags (tag, chirp_id) VALUES (?, ?)`, tag, c.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateSQLiteTags stores the hashtags of every chirp on its row
+// and in chirp_tags to look chirps up by tag
+func migrateSQLiteTags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE chirps ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE chirp_tags (
+	tag      TEXT    NOT NULL,
+	chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+	PRIMARY KEY (tag, chirp_id)
+) WITHOUT ROWID;
+
+CREATE INDEX chirp_tags_chirp_id ON chirp_tags (chirp_id);
+`)
+	if err != nil {
+		return err
+	}
+
+	chirps := []Chirp{}
+	err = scanRows(tx, `SELECT id, body FROM chirps`, func(rows *sql.Rows) error {
+		c := Chirp{}
+		err := rows.Scan(&c.Id, &c.Body)
+		chirps = append(chirps, c)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chirps {
+		c.Tags = extractTags(c.Body)
+		if len(c.Tags) == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE chirps SET tags = ? WHERE id = ?`, joinTags(c.Tags), c.Id)
+		if err == nil {
+			err = insertChirpTags(tx, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
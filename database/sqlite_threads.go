@@ -0,0 +1,104 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// GetThread returns the whole thread a chirp is part of, from its root
+func (s *SQLiteDB) GetThread(id int) (Thread, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Thread{}, err
+	}
+	defer tx.Rollback()
+
+	var rootId int
+
+	err = tx.QueryRow(`
+WITH RECURSIVE up (id, in_reply_to) AS (
+	SELECT id, in_reply_to FROM chirps WHERE id = ?
+	UNION ALL
+	SELECT chirps.id, chirps.in_reply_to FROM chirps JOIN up ON chirps.id = up.in_reply_to
+)
+SELECT id FROM up WHERE in_reply_to IS NULL`, id).Scan(&rootId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Thread{}, ErrNotFound
+	}
+	if err != nil {
+		return Thread{}, err
+	}
+
+	chirps := map[int]Chirp{}
+	replies := map[int][]int{}
+
+	err = scanRows(tx, `
+WITH RECURSIVE thread (id) AS (
+	SELECT ?
+	UNION ALL
+	SELECT chirps.id FROM chirps JOIN thread ON chirps.in_reply_to = thread.id
+)
+SELECT `+chirpColumns+` FROM chirps WHERE id IN thread ORDER BY id`, func(rows *sql.Rows) error {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return err
+		}
+
+		chirps[c.Id] = c
+		if c.InReplyTo != 0 {
+			replies[c.InReplyTo] = append(replies[c.InReplyTo], c.Id)
+		}
+
+		return nil
+	}, rootId)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	return buildThread(chirps[rootId], chirps, replies), nil
+}
+
+// checkReply makes sure the chirp a new one replies to is there
+func checkReply(tx *sql.Tx, inReplyTo int) error {
+	var gone bool
+
+	err := tx.QueryRow(`SELECT deleted OR hidden FROM chirps WHERE id = ?`, inReplyTo).Scan(&gone)
+	if errors.Is(err, sql.ErrNoRows) || gone {
+		return ErrInvalidReply
+	}
+
+	return err
+}
+
+// pruneTombstones deletes the tombstones up the thread from id
+// that the last of their replies was deleted from
+func pruneTombstones(tx *sql.Tx, id int) error {
+	for id != 0 {
+		var inReplyTo sql.NullInt64
+
+		err := tx.QueryRow(`
+DELETE FROM chirps
+WHERE id = ? AND deleted = 1 AND NOT EXISTS (SELECT 1 FROM chirps AS replies WHERE replies.in_reply_to = chirps.id)
+RETURNING in_reply_to`, id).Scan(&inReplyTo)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id = int(inReplyTo.Int64)
+	}
+
+	return nil
+}
+
+// migrateSQLiteReplies lets chirps reply to each other. The reference
+// is only checked on commit, so a chirp with replies can be swapped
+// for its tombstone and a restore can insert chirps in any order
+var migrateSQLiteReplies = execSQL(`
+ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER REFERENCES chirps (id) DEFERRABLE INITIALLY DEFERRED;
+ALTER TABLE chirps ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to);
+`)
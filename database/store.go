@@ -0,0 +1,82 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Store is the persistence layer used by the api handlers,
+// implemented by the json file database and by sqlite
+type Store interface {
+	CreateChirp(authorId int, body string, inReplyTo int, flags []string) (Chirp, error)
+	GetChirps(q ChirpQuery) ([]Chirp, error)
+	GetThread(id int) (Thread, error)
+	SearchChirps(q SearchQuery) ([]Chirp, error)
+	TrendingTags(since time.Time, limit int) ([]TagCount, error)
+	GetNotifications(q NotificationQuery) ([]Notification, error)
+	MarkNotificationsRead(userId int, ids []int) (int, error)
+	GetChirp(id int) (Chirp, error)
+	DeleteChirp(id int) (Chirp, error)
+	EditChirp(id int, authorId int, body string, flags []string, window time.Duration) (Chirp, error)
+	GetRevisions(id int) ([]Revision, error)
+	AddReaction(kind string, chirpId int, userId int) (Chirp, error)
+	RemoveReaction(kind string, chirpId int, userId int) (Chirp, error)
+	GetReactions(q ReactionQuery) ([]Reaction, error)
+	GetTimeline(q TimelineQuery) ([]Chirp, error)
+
+	ReportChirp(chirpId int, reporterId int, reason string) (Report, error)
+	GetModerationQueue(q QueueQuery) ([]QueueItem, error)
+	Moderate(chirpId int, adminId int, action string) (ModerationAction, error)
+	GetModerationActions(q ModerationActionQuery) ([]ModerationAction, error)
+
+	CreateUser(email string, password string, handle string) (User, error)
+	UpdateUser(id int, email string, password string, handle string, profile ProfileUpdate, isChirpyRed bool) (User, error)
+	Login(email string, password string) (User, error)
+	GetUser(id int) (User, error)
+	GetProfile(id int) (UserProfile, error)
+	SetAdmin(email string, isAdmin bool) (User, error)
+	DeleteUser(id int) (User, error)
+	RecordLogin(l Login) error
+	ExportUser(id int) (Export, error)
+	Follow(followerId int, followeeId int) (Follow, error)
+	Unfollow(followerId int, followeeId int) error
+	GetFollows(q FollowQuery) ([]Follow, error)
+
+	RevokeToken(token string, expiresAt time.Time) error
+	IsRevoked(token string) (bool, error)
+	PurgeRevokedTokens(now time.Time) (int, error)
+	CountRevokedTokens() (int, error)
+
+	// Backup writes a consistent snapshot of the whole database to w,
+	// Restore validates one and swaps it in for the current data
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+
+	Close() error
+}
+
+// Open opens the store for the given driver, falling back
+// to the driver's default file when path is empty.
+// opts only apply to the json driver
+func Open(driver, path string, opts Options) (Store, error) {
+	switch driver {
+	case DriverJSON:
+		if path == "" {
+			path = "db.json"
+		}
+		return NewDb(path, opts)
+	case DriverSQLite:
+		if path == "" {
+			path = "chirpy.db"
+		}
+		return NewSQLiteDb(path)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxTagLength is the most runes of a hashtag that count,
+// longer ones are ignored rather than cut short
+const maxTagLength = 64
+
+// TagCount is how many chirps used a tag
+type TagCount struct {
+	Tag    string `json:"tag"`
+	Chirps int    `json:"chirps"`
+}
+
+func isTagRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// normalizeTag returns the form tags are stored and looked up in,
+// or "" if tag isn't one. A tag needs a letter, #2024 isn't a tag
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+
+	n, letters := 0, 0
+	for _, r := range tag {
+		if !isTagRune(r) {
+			return ""
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+		n++
+	}
+
+	if letters == 0 || n > maxTagLength {
+		return ""
+	}
+
+	return tag
+}
+
+// extractTags returns the distinct hashtags in body in the order they
+// first appear. A # only starts a tag at the start of a word, so
+// urls with fragments and c#-like words don't count
+func extractTags(body string) []string {
+	var tags []string
+	seen := map[string]bool{}
+
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '#' || (i > 0 && (isTagRune(runes[i-1]) || runes[i-1] == '#' || runes[i-1] == '/')) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && isTagRune(runes[end]) {
+			end++
+		}
+
+		tag := normalizeTag(string(runes[i+1 : end]))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+
+		i = end - 1
+	}
+
+	return tags
+}
+
+// indexTags adds a chirp to the chirps of each of its tags
+func (ds *DbStructure) indexTags(c Chirp) {
+	for _, tag := range c.Tags {
+		if ds.tags[tag] == nil {
+			ds.tags[tag] = &sortedChirps{}
+		}
+
+		ds.insertSorted(ds.tags[tag], c)
+	}
+}
+
+func (ds *DbStructure) unindexTags(c Chirp) {
+	for _, tag := range c.Tags {
+		tagged, ok := ds.tags[tag]
+		if !ok {
+			continue
+		}
+
+		ds.removeSorted(tagged, c)
+		if len(tagged.byId) == 0 {
+			delete(ds.tags, tag)
+		}
+	}
+}
+
+// TrendingTags returns the tags used by the most chirps created since
+func (db *DB) TrendingTags(since time.Time, limit int) ([]TagCount, error) {
+	counts := []TagCount{}
+
+	err := db.View(func(ds *DbStructure) error {
+		from := Cursor{CreatedAt: since}
+
+		for tag, tagged := range ds.tags {
+			n := len(tagged.byTime) - ds.search(tagged.byTime, from, SortByCreatedAt)
+			if n > 0 {
+				counts = append(counts, TagCount{Tag: tag, Chirps: n})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return topTags(counts, limit), nil
+}
+
+// topTags orders tags by use, then by name so ties are stable
+func topTags(counts []TagCount, limit int) []TagCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Chirps != counts[j].Chirps {
+			return counts[i].Chirps > counts[j].Chirps
+		}
+		return counts[i].Tag < counts[j].Tag
+	})
+
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+
+	return counts
+}
+
+// migrateTags extracts the hashtags of the chirps from before tags
+func migrateTags(doc document) error {
+	chirps := map[string]map[string]json.RawMessage{}
+
+	err := doc.get("chirps", &chirps)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chirps {
+		var body string
+
+		if raw, ok := c["body"]; ok {
+			err = json.Unmarshal(raw, &body)
+			if err != nil {
+				return err
+			}
+		}
+
+		tags := extractTags(body)
+		if len(tags) == 0 {
+			continue
+		}
+
+		c["tags"], err = json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(chirps) == 0 {
+		return nil
+	}
+
+	return doc.set("chirps", chirps)
+}
@@ -0,0 +1,109 @@
+package database
+
+import "time"
+
+// Thread is a chirp with the replies to it nested below, oldest first
+type Thread struct {
+	Chirp
+	// ReplyCount counts the replies anywhere below the chirp,
+	// tombstones left by deleted replies aren't counted
+	ReplyCount int      `json:"reply_count"`
+	Replies    []Thread `json:"replies"`
+}
+
+// tombstone is what is left of a deleted chirp that has replies,
+// it keeps its place in the thread and nothing of what was said
+func tombstone(c Chirp, deletedAt time.Time) Chirp {
+	return Chirp{
+		Id:        c.Id,
+		InReplyTo: c.InReplyTo,
+		Deleted:   true,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: deletedAt,
+	}
+}
+
+// buildThread nests the replies below c, replies holds the
+// ids of the replies to each chirp of the thread in order.
+// Hidden chirps show as tombstones. Both drivers build threads with it
+func buildThread(c Chirp, chirps map[int]Chirp, replies map[int][]int) Thread {
+	if c.Hidden {
+		c = tombstone(c, c.UpdatedAt)
+	}
+
+	t := Thread{Chirp: c, Replies: []Thread{}}
+
+	for _, id := range replies[c.Id] {
+		reply := buildThread(chirps[id], chirps, replies)
+
+		t.ReplyCount += reply.ReplyCount
+		if !reply.Deleted {
+			t.ReplyCount++
+		}
+
+		t.Replies = append(t.Replies, reply)
+	}
+
+	return t
+}
+
+// indexReply adds a new chirp to the replies of the chirp it replies
+// to, new chirps have the highest id so they go last
+func (ds *DbStructure) indexReply(c Chirp) {
+	if c.InReplyTo != 0 {
+		ds.replies[c.InReplyTo] = append(ds.replies[c.InReplyTo], c.Id)
+	}
+}
+
+func (ds *DbStructure) unindexReply(c Chirp) {
+	delete(ds.replies, c.Id)
+
+	if c.InReplyTo == 0 {
+		return
+	}
+
+	ids := ds.replies[c.InReplyTo][:0]
+	for _, id := range ds.replies[c.InReplyTo] {
+		if id != c.Id {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		delete(ds.replies, c.InReplyTo)
+		return
+	}
+
+	ds.replies[c.InReplyTo] = ids
+}
+
+// GetThread returns the whole thread a chirp is part of, from its root
+func (db *DB) GetThread(id int) (Thread, error) {
+	var t Thread
+
+	err := db.View(func(ds *DbStructure) error {
+		c, ok := ds.Chirps[id]
+		if !ok {
+			return ErrNotFound
+		}
+
+		// a parent missing from a damaged file ends the walk early,
+		// the thread starts at the last chirp that is there
+		for c.InReplyTo != 0 {
+			parent, ok := ds.Chirps[c.InReplyTo]
+			if !ok {
+				break
+			}
+			c = parent
+		}
+
+		t = buildThread(c, ds.Chirps, ds.replies)
+
+		return nil
+	})
+	if err != nil {
+		return Thread{}, err
+	}
+
+	return t, nil
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// maxRefreshTokenAge is the longest a refresh token has ever been valid,
+// revocations stored before their expiry was recorded expire after it
+const maxRefreshTokenAge = 60 * 24 * time.Hour
+
+// tokenKey is what a revoked token is stored under,
+// the hash is enough to recognise it but can't be used to log in
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateRevokedTokens rekeys revocations from the token itself to its
+// hash and gives them an expiry, so they can be purged
+func migrateRevokedTokens(doc document) error {
+	old := map[string]time.Time{}
+
+	err := doc.get("revoked_tokens", &old)
+	if err != nil {
+		return err
+	}
+
+	revoked := make(map[string]RevokedToken, len(old))
+	for token, revokedAt := range old {
+		revoked[tokenKey(token)] = RevokedToken{
+			RevokedAt: revokedAt,
+			// the token was issued before it was revoked
+			ExpiresAt: revokedAt.Add(maxRefreshTokenAge),
+		}
+	}
+
+	return doc.set("revoked_tokens", revoked)
+}
@@ -0,0 +1,456 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OpCreateChirp = "chirp.create"
+	OpDeleteChirp = "chirp.delete"
+	OpCreateUser  = "user.create"
+	OpUpdateUser  = "user.update"
+	OpDeleteUser  = "user.delete"
+	OpRevokeToken = "token.revoke"
+	OpPurgeTokens = "token.purge"
+
+	// OpTombstoneChirp deletes a chirp that has replies, see tombstone
+	OpTombstoneChirp = "chirp.tombstone"
+	OpEditChirp      = "chirp.edit"
+
+	OpCreateNotification = "notification.create"
+	OpReadNotifications  = "notification.read"
+
+	OpAddReaction    = "reaction.add"
+	OpRemoveReaction = "reaction.remove"
+
+	OpCreateReport  = "report.create"
+	OpModerateChirp = "chirp.moderate"
+
+	OpFollow   = "follow.add"
+	OpUnfollow = "follow.remove"
+
+	OpLogin = "user.login"
+)
+
+const defaultCompactEvery = 1000
+
+// Record is a single mutation of the database. Every Update is made of
+// records, with the write-ahead log on they are appended to the log
+// file instead of rewriting the snapshot
+type Record struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Op    string    `json:"op"`
+	Id    int       `json:"id,omitempty"`
+	Chirp *Chirp    `json:"chirp,omitempty"`
+	User  *User     `json:"user,omitempty"`
+	// Token is the key of a revoked token, see tokenKey
+	Token   string        `json:"token,omitempty"`
+	Revoked *RevokedToken `json:"revoked,omitempty"`
+
+	Notification *Notification `json:"notification,omitempty"`
+	// Ids are the notifications marked read by OpReadNotifications
+	Ids []int `json:"ids,omitempty"`
+
+	Reaction *Reaction `json:"reaction,omitempty"`
+	// Revision is the body an OpEditChirp replaced
+	Revision *Revision `json:"revision,omitempty"`
+
+	Report *Report           `json:"report,omitempty"`
+	Action *ModerationAction `json:"action,omitempty"`
+	Follow *Follow           `json:"follow,omitempty"`
+	Login  *Login            `json:"login,omitempty"`
+}
+
+// record applies r to ds and queues it for the log,
+// every mutation inside Update goes through here
+func (ds *DbStructure) record(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	err := ds.apply(r)
+	if err != nil {
+		return err
+	}
+
+	ds.pending = append(ds.pending, r)
+
+	return nil
+}
+
+// apply makes the change described by r,
+// it is shared by record and log replay
+func (ds *DbStructure) apply(r Record) error {
+	switch r.Op {
+	case OpCreateChirp:
+		ds.Chirps[r.Chirp.Id] = *r.Chirp
+		ds.indexChirp(*r.Chirp)
+		ds.indexReply(*r.Chirp)
+		ds.Sequences.Chirps = max(ds.Sequences.Chirps, r.Chirp.Id)
+	case OpDeleteChirp:
+		ds.unindexChirp(ds.Chirps[r.Id])
+		ds.unindexReply(ds.Chirps[r.Id])
+		ds.dropChirpNotifications(r.Id, ds.Chirps[r.Id].Mentions)
+		ds.dropReactions(r.Id)
+		ds.dropOpenReports(r.Id)
+		delete(ds.Revisions, r.Id)
+		delete(ds.Chirps, r.Id)
+	case OpTombstoneChirp:
+		ds.unindexChirp(ds.Chirps[r.Id])
+		ds.dropChirpNotifications(r.Id, ds.Chirps[r.Id].Mentions)
+		ds.dropReactions(r.Id)
+		ds.dropOpenReports(r.Id)
+		delete(ds.Revisions, r.Id)
+		ds.Chirps[r.Id] = tombstone(ds.Chirps[r.Id], r.Time)
+	case OpEditChirp:
+		old := ds.Chirps[r.Chirp.Id]
+		ds.unindexChirp(old)
+		ds.dropChirpNotifications(old.Id, unmentioned(old.Mentions, r.Chirp.Mentions))
+		ds.Chirps[r.Chirp.Id] = *r.Chirp
+		ds.indexChirp(*r.Chirp)
+		ds.Revisions[r.Chirp.Id] = append(ds.Revisions[r.Chirp.Id], *r.Revision)
+	case OpAddReaction, OpRemoveReaction:
+		reactions := ds.reactions(r.Reaction.Kind)
+		if reactions == nil {
+			return fmt.Errorf("unknown reaction %q", r.Reaction.Kind)
+		}
+
+		c := ds.Chirps[r.Reaction.ChirpId]
+		if r.Op == OpAddReaction {
+			ds.putReaction(*r.Reaction)
+			c.countReaction(r.Reaction.Kind, 1)
+		} else {
+			delete(reactions[r.Reaction.ChirpId], r.Reaction.UserId)
+			if len(reactions[r.Reaction.ChirpId]) == 0 {
+				delete(reactions, r.Reaction.ChirpId)
+			}
+			c.countReaction(r.Reaction.Kind, -1)
+		}
+		ds.Chirps[c.Id] = c
+	case OpCreateReport:
+		ds.Reports[r.Report.Id] = *r.Report
+		ds.openReports[r.Report.ChirpId] = append(ds.openReports[r.Report.ChirpId], r.Report.Id)
+		ds.Sequences.Reports = max(ds.Sequences.Reports, r.Report.Id)
+	case OpModerateChirp:
+		ds.moderate(*r.Action)
+		ds.Sequences.ModerationActions = max(ds.Sequences.ModerationActions, r.Action.Id)
+	case OpFollow:
+		ds.putFollow(*r.Follow)
+	case OpUnfollow:
+		ds.dropFollow(*r.Follow)
+	case OpCreateUser, OpUpdateUser:
+		ds.indexUser(ds.Users[r.User.Id], *r.User)
+		ds.Users[r.User.Id] = *r.User
+		ds.Sequences.Users = max(ds.Sequences.Users, r.User.Id)
+	case OpLogin:
+		ds.putLogin(*r.Login)
+	case OpDeleteUser:
+		ds.dropUser(r.Id)
+	case OpCreateNotification:
+		ds.Notifications[r.Notification.Id] = *r.Notification
+		ds.inbox[r.Notification.UserId] = append(ds.inbox[r.Notification.UserId], r.Notification.Id)
+		ds.Sequences.Notifications = max(ds.Sequences.Notifications, r.Notification.Id)
+	case OpReadNotifications:
+		for _, id := range r.Ids {
+			n := ds.Notifications[id]
+			readAt := r.Time
+			n.ReadAt = &readAt
+			ds.Notifications[id] = n
+		}
+	case OpRevokeToken:
+		ds.RevokedTokens[r.Token] = *r.Revoked
+	case OpPurgeTokens:
+		for key, t := range ds.RevokedTokens {
+			if t.ExpiresAt.Before(r.Time) {
+				delete(ds.RevokedTokens, key)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown record op %q", r.Op)
+	}
+
+	return nil
+}
+
+// logPath is the write-ahead log next to the snapshot
+func (db *DB) logPath() string {
+	return db.path + ".log"
+}
+
+// startLog loads the snapshot, replays the log on top of it
+// and opens the log for appending
+func (db *DB) startLog() error {
+	ds, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	db.logSeq = ds.LogSeq
+
+	err = db.replayLog(&ds)
+	if err != nil {
+		return err
+	}
+
+	db.cache = &ds
+
+	db.log, err = os.OpenFile(db.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(db.path))
+}
+
+// foldLog compacts a log left behind by a previous run with the
+// write-ahead log on, so opening without it doesn't lose changes
+func (db *DB) foldLog() error {
+	info, err := os.Stat(db.logPath())
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = db.startLog()
+	if err == nil {
+		err = db.compact()
+	}
+	if db.log != nil {
+		db.log.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	db.cache = nil
+	db.log = nil
+
+	return os.Remove(db.logPath())
+}
+
+// replayLog applies the records the snapshot doesn't have yet.
+// A torn record at the end of the log, from a crash mid-append,
+// is cut off since it was never acknowledged
+func (db *DB) replayLog(ds *DbStructure) error {
+	f, err := os.OpenFile(db.logPath(), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+
+		r := Record{}
+		if err == io.EOF || json.Unmarshal(line, &r) != nil {
+			if _, err := reader.Peek(1); err != io.EOF {
+				return fmt.Errorf("%w: bad record at offset %d of %s", ErrCorruptDB, offset, db.logPath())
+			}
+
+			log.Printf("truncating torn record at offset %d of %s", offset, db.logPath())
+
+			return f.Truncate(offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		offset += int64(len(line))
+		db.logSeq = max(db.logSeq, r.Seq)
+
+		if r.Seq <= ds.LogSeq {
+			continue
+		}
+
+		err = ds.apply(r)
+		if err != nil {
+			return err
+		}
+
+		ds.LogSeq = r.Seq
+		db.logCount++
+	}
+}
+
+// appendLog writes records to the log and syncs it,
+// callers must hold db.mux
+func (db *DB) appendLog(records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+	seq := db.logSeq
+
+	for _, r := range records {
+		seq++
+		r.Seq = seq
+
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	_, err := db.log.Write(buf.Bytes())
+	if err == nil {
+		err = db.log.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	db.logSeq = seq
+	db.cache.LogSeq = seq
+	db.logCount += len(records)
+
+	return nil
+}
+
+// commitLog appends the records of an Update and compacts once enough
+// piled up, callers must hold db.mux
+func (db *DB) commitLog(records []Record) error {
+	err := db.appendLog(records)
+	if err != nil {
+		reloadErr := db.reloadLog()
+		if reloadErr != nil {
+			log.Print("reload log: ", reloadErr)
+		}
+
+		return err
+	}
+
+	if db.logCount >= db.opts.compactEvery() {
+		return db.compact()
+	}
+
+	return nil
+}
+
+// reloadLog throws the cache away and rebuilds it from disk,
+// used when an append fails after the cache was already changed
+func (db *DB) reloadLog() error {
+	err := db.log.Close()
+	if err != nil {
+		return err
+	}
+
+	db.cache = nil
+	db.logCount = 0
+
+	return db.startLog()
+}
+
+// compact writes the cache as the new snapshot and archives the log
+// it covers as a segment named after its last seq, the segments are
+// kept as an audit trail unless Options.KeepSegments limits them.
+// Callers must hold db.mux
+func (db *DB) compact() error {
+	if db.logCount == 0 {
+		return nil
+	}
+
+	// records up to LogSeq are skipped on replay, so a crash
+	// between the snapshot and the rotation loses nothing
+	err := db.writeDB(*db.cache)
+	if err != nil {
+		return err
+	}
+
+	err = db.log.Close()
+	if err != nil {
+		return err
+	}
+
+	// if the rename fails the log is reopened and appended to,
+	// replay skips what the snapshot already has
+	segment := fmt.Sprintf("%s.%d", db.logPath(), db.logSeq)
+	renameErr := os.Rename(db.logPath(), segment)
+
+	db.log, err = os.OpenFile(db.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if renameErr != nil {
+		return renameErr
+	}
+
+	db.logCount = 0
+
+	if db.opts.KeepSegments > 0 {
+		err = db.pruneSegments(db.opts.KeepSegments)
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncDir(filepath.Dir(db.path))
+}
+
+// pruneSegments removes the archived log segments other than the
+// latest keep, the snapshots after them already hold their records
+func (db *DB) pruneSegments(keep int) error {
+	paths, err := filepath.Glob(db.logPath() + ".*")
+	if err != nil {
+		return err
+	}
+
+	segments := map[uint64]string{}
+	seqs := []uint64{}
+
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(path, db.logPath()+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments[seq] = path
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for _, seq := range seqs[:max(len(seqs)-keep, 0)] {
+		err = os.Remove(segments[seq])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o Options) compactEvery() int {
+	if o.CompactEvery > 0 {
+		return o.CompactEvery
+	}
+
+	return defaultCompactEvery
+}
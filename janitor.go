@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bootdev/database"
+	"context"
+	"log"
+	"time"
+)
+
+// purgeRevokedTokens forgets expired revocations every interval
+// until ctx is done, counting how many it dropped
+func (cfg *apiConfig) purgeRevokedTokens(ctx context.Context, store database.Store, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := store.PurgeRevokedTokens(now)
+			if err != nil {
+				log.Print("PurgeRevokedTokens: ", err)
+				continue
+			}
+
+			if n > 0 {
+				log.Printf("purged %d expired revoked tokens", n)
+				cfg.revokedTokensPurged.Add(int64(n))
+			}
+		}
+	}
+}
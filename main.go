@@ -3,9 +3,18 @@ package main
 import (
 	"bootdev/api"
 	"bootdev/database"
+	"bootdev/moderation"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -13,16 +22,82 @@ import (
 const port = "8080"
 
 type apiConfig struct {
-	fileServerHits int
+	fileServerHits      int
+	revokedTokensPurged atomic.Int64
 }
 
 func main() {
-	err := database.NewDb()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "migrate":
+		err = migrate(args)
+	case "backup":
+		err = backup(args)
+	case "restore":
+		err = restore(args)
+	case "grant-admin":
+		err = grantAdmin(args)
+	default:
+		err = fmt.Errorf("unknown command %q, want serve, migrate, backup, restore or grant-admin", cmd)
+	}
+
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	apiCfg := apiConfig{}
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	db := addDbFlags(fs)
+	dbCache := fs.Bool("db-cache", false, "json: keep the database in memory and serve reads from it")
+	dbFlushInterval := fs.Duration("db-flush-interval", 0, "json: with -db-cache, write changes to disk every interval")
+	dbFlushBatch := fs.Int("db-flush-batch", 0, "json: with -db-cache, write changes to disk once this many are pending")
+	dbWAL := fs.Bool("db-wal", false, "json: append changes to a write-ahead log, implies -db-cache")
+	dbCompactEvery := fs.Int("db-compact-every", 0, "json: with -db-wal, log records between snapshots, defaults to 1000")
+	dbKeepSegments := fs.Int("db-keep-segments", 0, "json: with -db-wal, how many archived log segments to keep, 0 keeps all")
+	purgeInterval := fs.Duration("token-purge-interval", time.Hour, "how often to forget revoked tokens that have expired")
+	editWindow := fs.Duration("chirp-edit-window", 15*time.Minute, "how long after posting authors can edit a chirp, 0 turns editing off")
+	rulesPath := fs.String("moderation-rules", "", "json file of moderation rules, reloaded when it or its word lists change")
+	exportInterval := fs.Duration("export-interval", time.Hour, "how long users wait between two exports of their data")
+	rulesReload := fs.Duration("moderation-reload-interval", 10*time.Second, "how often to check the moderation rules for changes")
+	fs.Parse(args)
+
+	moderator := moderation.Default()
+	if *rulesPath != "" {
+		var err error
+
+		moderator, err = moderation.Open(*rulesPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := database.Open(db.driver, db.path, database.Options{
+		Cache:         *dbCache,
+		FlushInterval: *dbFlushInterval,
+		FlushBatch:    *dbFlushBatch,
+		WAL:           *dbWAL,
+		CompactEvery:  *dbCompactEvery,
+		KeepSegments:  *dbKeepSegments,
+	})
+	if err != nil {
+		return err
+	}
+
+	api.SetStore(store)
+	api.SetEditWindow(*editWindow)
+	api.SetExportInterval(*exportInterval)
+	api.SetModerator(moderator)
+
+	apiCfg := &apiConfig{}
 
 	router := chi.NewRouter()
 	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("public"))))
@@ -37,12 +112,39 @@ func main() {
 	apiRouter.Get("/healthz", api.Healthz)
 
 	apiRouter.Post("/chirps", api.CreateChirp)
+	apiRouter.Get("/chirps/search", api.SearchChirps)
 	apiRouter.Get("/chirps/{id}", api.GetChirp)
+	apiRouter.Put("/chirps/{id}", api.EditChirp)
+	apiRouter.Get("/chirps/{id}/revisions", api.GetRevisions)
+	apiRouter.Get("/chirps/{id}/thread", api.GetThread)
+	apiRouter.Post("/chirps/{id}/likes", api.AddReaction(database.ReactionLike))
+	apiRouter.Delete("/chirps/{id}/likes", api.RemoveReaction(database.ReactionLike))
+	apiRouter.Get("/chirps/{id}/likes", api.GetReactions(database.ReactionLike))
+	apiRouter.Post("/chirps/{id}/rechirps", api.AddReaction(database.ReactionRechirp))
+	apiRouter.Delete("/chirps/{id}/rechirps", api.RemoveReaction(database.ReactionRechirp))
+	apiRouter.Get("/chirps/{id}/rechirps", api.GetReactions(database.ReactionRechirp))
+	apiRouter.Post("/chirps/{id}/reports", api.ReportChirp)
 	apiRouter.Get("/chirps", api.GetChrips)
 	apiRouter.Delete("/chirps/{id}", api.DeleteChirp)
 
+	apiRouter.Get("/tags/trending", api.TrendingTags)
+	apiRouter.Get("/tags/{tag}/chirps", api.GetTagChirps)
+
 	apiRouter.Post("/users", api.CreateUser)
 	apiRouter.Put("/users", api.UpdateUser)
+	apiRouter.Delete("/users", api.DeleteUser)
+	apiRouter.Get("/users/me/export", api.ExportUser)
+	apiRouter.Get("/users/{id}", api.GetUserProfile)
+	apiRouter.Get("/users/{id}/mentions", api.GetUserMentions)
+	apiRouter.Post("/users/{id}/follow", api.Follow)
+	apiRouter.Delete("/users/{id}/follow", api.Unfollow)
+	apiRouter.Get("/users/{id}/followers", api.GetFollows(false))
+	apiRouter.Get("/users/{id}/following", api.GetFollows(true))
+
+	apiRouter.Get("/timeline", api.GetTimeline)
+
+	apiRouter.Get("/notifications", api.GetNotifications)
+	apiRouter.Post("/notifications/read", api.ReadNotifications)
 
 	apiRouter.Post("/login", api.Login)
 	apiRouter.Post("/refresh", api.RefreshToken)
@@ -53,8 +155,25 @@ func main() {
 	// admin
 	adminRouter := chi.NewRouter()
 	adminRouter.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		revoked, err := store.CountRevokedTokens()
+		if err != nil {
+			log.Print("CountRevokedTokens: ", err)
+		}
+
 		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(fmt.Sprintf(adminTemplate, apiCfg.fileServerHits)))
+		w.Write([]byte(fmt.Sprintf(adminTemplate, apiCfg.fileServerHits, revoked, apiCfg.revokedTokensPurged.Load())))
+	})
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(api.RequireAdmin)
+
+		r.Get("/backup", api.Backup)
+		r.Post("/restore", api.Restore)
+
+		r.Get("/moderation", api.GetModerationQueue)
+		r.Get("/moderation/actions", api.GetModerationActions)
+		r.Post("/moderation/{id}/{action}", api.Moderate)
+
+		r.Delete("/users/{id}", api.DeleteAnyUser)
 	})
 
 	router.Mount("/api", apiRouter)
@@ -66,6 +185,43 @@ func main() {
 		Handler: corsMux,
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go moderator.Watch(ctx, *rulesReload)
+
+	// closed once the janitor stopped
+	purged := make(chan struct{})
+
+	go func() {
+		defer close(purged)
+		apiCfg.purgeRevokedTokens(ctx, store, *purgeInterval)
+	}()
+
+	// closed once in flight requests are done
+	idle := make(chan struct{})
+
+	go func() {
+		defer close(idle)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Print("Shutdown: ", err)
+		}
+	}()
+
 	fmt.Printf("Serving on %s\n", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-idle
+	<-purged
+
+	// flush anything the database still holds in memory
+	return store.Close()
 }
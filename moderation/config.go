@@ -0,0 +1,245 @@
+package moderation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ruleConfig is a rule in the rules file. A rule has a pattern or
+// words, words_file is a list of them one per line next to the file
+type ruleConfig struct {
+	Name      string   `json:"name"`
+	Action    Action   `json:"action"`
+	Words     []string `json:"words,omitempty"`
+	WordsFile string   `json:"words_file,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+}
+
+type rulesFile struct {
+	Rules []ruleConfig `json:"rules"`
+}
+
+// fileStamp tells whether a file changed since it was read,
+// the zero stamp stands for a file that isn't there
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// Open loads the rules in the json file at path,
+// see Watch to pick up changes to it
+func Open(path string) (*Moderator, error) {
+	m := &Moderator{path: path}
+
+	err := m.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Reload reads the rules file again, the rules
+// in place stay if it or a word list is bad
+func (m *Moderator) Reload() error {
+	files := map[string]fileStamp{}
+
+	rules, err := load(m.path, files)
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	// remember what was read either way, so a bad
+	// file is only reported again once it changes
+	m.files = files
+	if err != nil {
+		return err
+	}
+
+	m.rules = rules
+
+	return nil
+}
+
+// Watch reloads the rules when one of their files changes, checking
+// every interval until ctx is done. Errors are logged and the rules
+// from before stay in place
+func (m *Moderator) Watch(ctx context.Context, every time.Duration) {
+	if m.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !m.changed() {
+			continue
+		}
+
+		err := m.Reload()
+		if err != nil {
+			log.Print("moderation: ", err)
+			continue
+		}
+
+		log.Printf("moderation: reloaded rules from %s", m.path)
+	}
+}
+
+// changed reports whether a file the rules came from changed
+func (m *Moderator) changed() bool {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	for path, stamp := range m.files {
+		current := stampOf(path)
+		if !current.modTime.Equal(stamp.modTime) || current.size != stamp.size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reads the rules file at path, noting every file it read in files
+func load(path string, files map[string]fileStamp) ([]Rule, error) {
+	buf, err := readFile(path, files)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := rulesFile{}
+
+	err = json.Unmarshal(buf, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	rules := make([]Rule, 0, len(cfg.Rules))
+	names := map[string]bool{}
+
+	for i, rc := range cfg.Rules {
+		rule, err := rc.rule(filepath.Dir(path), files)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+
+		if names[rule.Name()] {
+			return nil, fmt.Errorf("%s: rule %d: there is another rule named %q", path, i+1, rule.Name())
+		}
+		names[rule.Name()] = true
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// rule builds the rule rc describes, word files are relative to dir
+func (rc ruleConfig) rule(dir string, files map[string]fileStamp) (Rule, error) {
+	if !validName(rc.Name) {
+		return nil, errors.New("names are letters, digits, - or _")
+	}
+
+	switch rc.Action {
+	case ActionCensor, ActionReject, ActionFlag:
+	default:
+		return nil, fmt.Errorf("unknown action %q, want censor, reject or flag", rc.Action)
+	}
+
+	if rc.Pattern != "" {
+		if len(rc.Words) > 0 || rc.WordsFile != "" {
+			return nil, errors.New("a rule has a pattern or words, not both")
+		}
+
+		return NewRegexRule(rc.Name, rc.Action, rc.Pattern)
+	}
+
+	words := rc.Words
+
+	if rc.WordsFile != "" {
+		path := rc.WordsFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		buf, err := readFile(path, files)
+		if err != nil {
+			return nil, err
+		}
+
+		words = append(words, parseWordList(buf)...)
+	}
+
+	if len(words) == 0 {
+		return nil, errors.New("a rule needs a pattern or words")
+	}
+
+	return NewWordRule(rc.Name, rc.Action, words), nil
+}
+
+// validName keeps rule names to one word, chirps store them space separated
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		if r != '-' && r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseWordList reads a word or phrase per line,
+// blank lines and lines starting with # are skipped
+func parseWordList(buf []byte) []string {
+	var words []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		words = append(words, line)
+	}
+
+	return words
+}
+
+// readFile reads a file the rules depend on and notes its stamp,
+// stamped before reading so a write in between triggers a reload
+func readFile(path string, files map[string]fileStamp) ([]byte, error) {
+	files[path] = stampOf(path)
+
+	return os.ReadFile(path)
+}
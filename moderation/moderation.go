@@ -0,0 +1,129 @@
+// Package moderation checks chirps against a set of rules, each of
+// which can censor what it matches, reject the chirp or flag it for
+// review. Rules can be loaded from a file that is reloaded on change
+package moderation
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Action is what happens to a chirp a rule matches
+type Action string
+
+const (
+	ActionCensor Action = "censor"
+	ActionReject Action = "reject"
+	ActionFlag   Action = "flag"
+)
+
+// Censored replaces the parts of a chirp censor rules match
+const Censored = "****"
+
+// Rule finds the parts of a chirp it objects to
+type Rule interface {
+	Name() string
+	Action() Action
+	// Match returns the byte ranges of text the rule matches
+	Match(text string) []Span
+}
+
+// Span is a byte range of a chirp, End is exclusive
+type Span struct {
+	Start, End int
+}
+
+// Verdict is what the rules made of a chirp
+type Verdict struct {
+	// Body is the chirp with what censor rules matched starred out
+	Body string
+	// RejectedBy names the rule that rejected the chirp, if one did
+	RejectedBy string
+	// Flags name the rules that want the chirp reviewed
+	Flags []string
+}
+
+// Moderator runs chirps through its rules, it is safe
+// to use while the rules are being reloaded
+type Moderator struct {
+	mux   sync.RWMutex
+	rules []Rule
+
+	// the rules file and the files it loaded, to reload them from
+	path  string
+	files map[string]fileStamp
+}
+
+// New returns a moderator with the given rules
+func New(rules ...Rule) *Moderator {
+	return &Moderator{rules: rules}
+}
+
+// Default returns a moderator that censors the words chirpy
+// always has, for when no rules file is configured
+func Default() *Moderator {
+	return New(NewWordRule("banned_words", ActionCensor, []string{"kerfuffle", "sharbert", "fornax"}))
+}
+
+// Check runs body through every rule
+func (m *Moderator) Check(body string) Verdict {
+	m.mux.RLock()
+	rules := m.rules
+	m.mux.RUnlock()
+
+	v := Verdict{Body: body}
+	var censored []Span
+
+	for _, rule := range rules {
+		spans := rule.Match(body)
+		if len(spans) == 0 {
+			continue
+		}
+
+		switch rule.Action() {
+		case ActionReject:
+			if v.RejectedBy == "" {
+				v.RejectedBy = rule.Name()
+			}
+		case ActionFlag:
+			v.Flags = append(v.Flags, rule.Name())
+		case ActionCensor:
+			censored = append(censored, spans...)
+		}
+	}
+
+	v.Body = censor(body, censored)
+
+	return v
+}
+
+// censor replaces the spans of text, overlapping ones are merged
+func censor(text string, spans []Span) string {
+	if len(spans) == 0 {
+		return text
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+
+	var b strings.Builder
+	last := 0
+
+	for i := 0; i < len(spans); i++ {
+		span := spans[i]
+		for i+1 < len(spans) && spans[i+1].Start <= span.End {
+			i++
+			span.End = max(span.End, spans[i].End)
+		}
+
+		b.WriteString(text[last:span.Start])
+		b.WriteString(Censored)
+		last = span.End
+	}
+
+	b.WriteString(text[last:])
+
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package moderation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	links, err := NewRegexRule("links", ActionFlag, `https?://\S+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(
+		NewWordRule("banned", ActionCensor, []string{"kerfuffle", "sharbert", "bad phrase"}),
+		NewWordRule("slurs", ActionReject, []string{"fornax"}),
+		links,
+	)
+
+	for _, tc := range []struct {
+		body, want string
+		rejected   bool
+		flagged    bool
+	}{
+		{body: "what a kerfuffle", want: "what a ****"},
+		{body: "Kerfuffle! and SHARBERT.", want: "****! and ****."},
+		{body: "ｋｅｒｆｕｆｆｌｅ", want: "****"},
+		{body: "kérfüffle", want: "****"},
+		{body: "ker\u200bfuffle", want: "****"},
+		{body: "a bad, phrase here", want: "a **** here"},
+		{body: "kerfuffles are fine", want: "kerfuffles are fine"},
+		{body: "fornax", rejected: true},
+		{body: "see https://example.com kerfuffle", want: "see https://example.com ****", flagged: true},
+	} {
+		v := m.Check(tc.body)
+
+		if (v.RejectedBy != "") != tc.rejected {
+			t.Errorf("%q rejected by %q, want rejected %v", tc.body, v.RejectedBy, tc.rejected)
+			continue
+		}
+		if (len(v.Flags) > 0) != tc.flagged {
+			t.Errorf("%q flagged by %v, want flagged %v", tc.body, v.Flags, tc.flagged)
+		}
+		if !tc.rejected && v.Body != tc.want {
+			t.Errorf("%q became %q, want %q", tc.body, v.Body, tc.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.json")
+	wordsPath := filepath.Join(dir, "words.txt")
+
+	write := func(path, content string) {
+		t.Helper()
+
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(rulesPath, `{"rules": [{"name": "words", "action": "censor", "words_file": "words.txt"}]}`)
+	write(wordsPath, "# banned\nfoo\n")
+
+	m, err := Open(rulesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.Check("foo bar").Body; got != "**** bar" {
+		t.Fatalf("before the change %q", got)
+	}
+
+	write(wordsPath, "# banned\nfoo\nbar\n")
+	os.Chtimes(wordsPath, time.Now(), time.Now().Add(time.Second))
+
+	if !m.changed() {
+		t.Fatal("changing a word list went unnoticed")
+	}
+
+	err = m.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.Check("foo bar").Body; got != "**** ****" {
+		t.Fatalf("after the change %q", got)
+	}
+
+	// a broken file keeps the rules from before
+	write(rulesPath, `{"rules": [{"name": "words", "action": "shout", "words": ["foo"]}]}`)
+
+	err = m.Reload()
+	if err == nil {
+		t.Fatal("loaded a rule with an unknown action")
+	}
+
+	if m.changed() {
+		t.Fatal("a broken file is reported again before it changes")
+	}
+
+	if got := m.Check("foo bar").Body; got != "**** ****" {
+		t.Fatalf("after a bad reload %q", got)
+	}
+}
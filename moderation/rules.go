@@ -0,0 +1,200 @@
+package moderation
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// wordRule matches words and phrases from a list, ignoring case,
+// punctuation and accents, so "Kérfuffle!" matches kerfuffle
+type wordRule struct {
+	name   string
+	action Action
+	// phrases holds the word lists to match by their first word
+	phrases map[string][][]string
+}
+
+// NewWordRule returns a rule matching any of words, an
+// entry of more than one word matches them in a row
+func NewWordRule(name string, action Action, words []string) Rule {
+	r := &wordRule{name: name, action: action, phrases: map[string][][]string{}}
+
+	for _, entry := range words {
+		var phrase []string
+		for _, t := range tokenize(entry) {
+			phrase = append(phrase, t.word)
+		}
+
+		if len(phrase) > 0 {
+			r.phrases[phrase[0]] = append(r.phrases[phrase[0]], phrase)
+		}
+	}
+
+	return r
+}
+
+func (r *wordRule) Name() string {
+	return r.name
+}
+
+func (r *wordRule) Action() Action {
+	return r.action
+}
+
+func (r *wordRule) Match(text string) []Span {
+	var spans []Span
+
+	tokens := tokenize(text)
+
+	for i, t := range tokens {
+	phrases:
+		for _, phrase := range r.phrases[t.word] {
+			if i+len(phrase) > len(tokens) {
+				continue
+			}
+
+			for j, word := range phrase[1:] {
+				if tokens[i+j+1].word != word {
+					continue phrases
+				}
+			}
+
+			spans = append(spans, Span{Start: t.start, End: tokens[i+len(phrase)-1].end})
+		}
+	}
+
+	return spans
+}
+
+// regexRule matches a regular expression against the chirp as it was
+// written, use (?i) in the pattern to ignore case
+type regexRule struct {
+	name    string
+	action  Action
+	pattern *regexp.Regexp
+}
+
+// NewRegexRule returns a rule matching a regular expression
+func NewRegexRule(name string, action Action, pattern string) (Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &regexRule{name: name, action: action, pattern: re}, nil
+}
+
+func (r *regexRule) Name() string {
+	return r.name
+}
+
+func (r *regexRule) Action() Action {
+	return r.action
+}
+
+func (r *regexRule) Match(text string) []Span {
+	var spans []Span
+
+	for _, loc := range r.pattern.FindAllStringIndex(text, -1) {
+		if loc[1] > loc[0] {
+			spans = append(spans, Span{Start: loc[0], End: loc[1]})
+		}
+	}
+
+	return spans
+}
+
+// token is a normalized word and where it is in the original text
+type token struct {
+	word       string
+	start, end int
+}
+
+// tokenize splits text into normalized words. Anything that isn't a
+// letter or digit separates words, except marks and invisible format
+// characters which are dropped so they can't be used to split one
+func tokenize(text string) []token {
+	var tokens []token
+	var word strings.Builder
+
+	t := token{start: -1}
+
+	flush := func() {
+		if t.start >= 0 {
+			t.word = word.String()
+			tokens = append(tokens, t)
+		}
+
+		word.Reset()
+		t = token{start: -1}
+	}
+
+	for i, r := range text {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if t.start < 0 {
+				t.start = i
+			}
+
+			word.WriteRune(fold(r))
+			t.end = i + utf8.RuneLen(r)
+		default:
+			flush()
+		}
+	}
+
+	flush()
+
+	return tokens
+}
+
+// fold maps a rune to the plain lowercase letter it stands for,
+// fullwidth forms to ascii and accented latin letters to their base
+func fold(r rune) rune {
+	if r >= 0xFF01 && r <= 0xFF5E {
+		r -= 0xFEE0
+	}
+
+	r = unicode.ToLower(r)
+
+	if base, ok := accents[r]; ok {
+		return base
+	}
+
+	return r
+}
+
+// accents maps the accented lowercase latin letters to their base letter
+var accents = map[rune]rune{}
+
+func init() {
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăąǎ",
+		'c': "çćĉċč",
+		'd': "ďđ",
+		'e': "èéêëēĕėęě",
+		'g': "ĝğġģ",
+		'h': "ĥħ",
+		'i': "ìíîïĩīĭįı",
+		'j': "ĵ",
+		'k': "ķ",
+		'l': "ĺļľŀł",
+		'n': "ñńņňŉ",
+		'o': "òóôõöøōŏő",
+		'r': "ŕŗř",
+		's': "śŝşšſ",
+		't': "ţťŧ",
+		'u': "ùúûüũūŭůűų",
+		'w': "ŵ",
+		'y': "ýÿŷ",
+		'z': "źżž",
+	} {
+		for _, r := range accented {
+			accents[r] = base
+		}
+	}
+}